@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager creates a manager that obtains and renews certificates for acmeHosts from an ACME server,
+// answering TLS-ALPN-01 challenges on the server's own listeners.
+// Certificates and the account key are cached in acmeCacheDir.
+// If no hosts are set, nil is returned.
+func newACMEManager(l *Logger) (*autocert.Manager, error) {
+	if len(acmeHosts) == 0 {
+		return nil, nil
+	}
+	client := &acme.Client{
+		DirectoryURL: acmeDirectoryURL,
+	}
+	if acmeRootCA != "" {
+		pemData, err := os.ReadFile(acmeRootCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("%w: no certificates found in %s", ErrCertNotValid, acmeRootCA)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:    pool,
+					MinVersion: tls.VersionTLS12,
+				},
+			},
+		}
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(acmeCacheDir),
+		HostPolicy: autocert.HostWhitelist(acmeHosts...),
+		Client:     client,
+		Email:      acmeEmail,
+	}
+	l.Debugf("ACME enabled for %v with directory %s, cached in %s\n", []string(acmeHosts), acmeDirectoryURL, acmeCacheDir)
+	return m, nil
+}
+
+// isACMEChallenge reports whether the client hello is a TLS-ALPN-01 challenge from an ACME server.
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			return true
+		}
+	}
+	return false
+}
+
+// allowACMEChallenges makes cfg answer TLS-ALPN-01 challenges without requesting a client certificate,
+// as ACME servers don't send one when validating a challenge.
+// The acme-tls/1 protocol is only negotiated with clients that offer it,
+// as a handshake fails if the client offers protocols and none of them are supported.
+func allowACMEChallenges(cfg *tls.Config) {
+	challenge := cfg.Clone()
+	challenge.NextProtos = []string{acme.ALPNProto}
+	challenge.ClientAuth = tls.NoClientCert
+	challenge.ClientCAs = nil
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if isACMEChallenge(hello) {
+			return challenge, nil
+		}
+		return nil, nil
+	}
+}
+
+// getACMECertificate returns a certificate from the ACME manager if the client hello is a challenge,
+// or requests a host the manager obtains certificates for.
+// If ok is false, the manager is not responsible for the client hello.
+func (cs *certStore) getACMECertificate(hello *tls.ClientHelloInfo) (cert *tls.Certificate, ok bool, err error) {
+	if cs.acme == nil {
+		return nil, false, nil
+	}
+	if isACMEChallenge(hello) {
+		cert, err = cs.acme.GetCertificate(hello)
+		return cert, true, err
+	}
+	if hello.ServerName == "" || cs.acme.HostPolicy(context.Background(), hello.ServerName) != nil {
+		return nil, false, nil
+	}
+	cert, err = cs.acme.GetCertificate(hello)
+	if err != nil {
+		// Keep serving with the configured certificate until one can be obtained.
+		cs.l.Errorf("Unable to obtain an ACME certificate for %s, using the configured certificate: %v\n", hello.ServerName, err)
+		return nil, false, nil
+	}
+	return cert, true, nil
+}
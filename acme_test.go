@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestACMEPebble obtains a certificate from a Pebble test server, answering the TLS-ALPN-01 challenge on a listener that requires client certificates.
+// It runs only when NVDAREMOTE_TEST_ACME_DIR is set to the directory URL of Pebble, such as https://127.0.0.1:14000/dir, with:
+//
+//	NVDAREMOTE_TEST_ACME_CA: the root certificate Pebble serves its API with, test/certs/pebble.minica.pem in the Pebble repository.
+//	NVDAREMOTE_TEST_ACME_HOST: a host name that resolves to this machine, such as one added to /etc/hosts.
+//	NVDAREMOTE_TEST_ACME_ADDR: the address to listen on, which must match the tlsPort of Pebble. (default :5001)
+//
+// Pebble should be started with PEBBLE_VA_NOSLEEP=1 so that the challenge is validated immediately.
+func TestACMEPebble(t *testing.T) {
+	dir := os.Getenv("NVDAREMOTE_TEST_ACME_DIR")
+	if dir == "" {
+		t.Skip("NVDAREMOTE_TEST_ACME_DIR is not set")
+	}
+	host := os.Getenv("NVDAREMOTE_TEST_ACME_HOST")
+	if host == "" {
+		t.Fatal("NVDAREMOTE_TEST_ACME_HOST is not set")
+	}
+	addr := os.Getenv("NVDAREMOTE_TEST_ACME_ADDR")
+	if addr == "" {
+		addr = ":5001"
+	}
+	tmp := t.TempDir()
+	l := NewLogger(LogLevelNone, LogFormatText)
+
+	certificateKeyType = CertKeyECDSAP256
+	fallback, err := genCert(false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Any certificate authority will do, as the challenge must be answered without a client certificate.
+	clientCAPath = filepath.Join(tmp, "clientca.pem")
+	clientAuthMode = ClientAuthRequire
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fallback.Certificate[0]})
+	if err := os.WriteFile(clientCAPath, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// With TLS 1.3, a client that sends no certificate finishes its handshake before the server rejects it,
+	// so the challenge is only known to fail without a client certificate with TLS 1.2.
+	tlsMaxVersion = "1.2"
+	acmeHosts = stringList{host}
+	acmeDirectoryURL = dir
+	acmeRootCA = os.Getenv("NVDAREMOTE_TEST_ACME_CA")
+	acmeCacheDir = filepath.Join(tmp, "acme")
+	defer func() {
+		clientCAPath, acmeHosts, tlsMaxVersion = "", nil, ""
+	}()
+
+	m, err := newACMEManager(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := newCertStore(fallback, m, l)
+	s, err := NewServer(certs, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := s.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = s.Serve(ln)
+	}()
+	defer s.Shutdown()
+
+	// Requesting the host obtains the certificate, which makes Pebble connect to the listener to validate the challenge.
+	cert, err := certs.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:   host,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert == certs.Load() {
+		t.Fatal("received the fallback certificate instead of one from the ACME server")
+	}
+	if cert.Leaf == nil || cert.Leaf.VerifyHostname(host) != nil {
+		t.Fatalf("certificate is not valid for %s", host)
+	}
+	if !strings.Contains(cert.Leaf.Issuer.CommonName, "Pebble") {
+		t.Errorf("certificate issued by %s, not Pebble", cert.Leaf.Issuer)
+	}
+}
+
+// TestACMEClientALPN connects to a listener with ACME enabled, offering the protocols a browser offers,
+// which must not make the handshake fail because the listener only supports acme-tls/1.
+func TestACMEClientALPN(t *testing.T) {
+	l := NewLogger(LogLevelNone, LogFormatText)
+	certificateKeyType = CertKeyECDSAP256
+	fallback, err := genCert(false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acmeHosts = stringList{"relay.example.org"}
+	acmeCacheDir = t.TempDir()
+	defer func() {
+		acmeHosts = nil
+	}()
+	m, err := newACMEManager(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(newCertStore(fallback, m, l), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = s.Serve(ln)
+	}()
+	defer s.Shutdown()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("handshake offering http/1.1 failed: %v", err)
+	}
+	defer conn.Close()
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "" {
+		t.Errorf("negotiated protocol %q, want none", proto)
+	}
+}
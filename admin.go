@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// admin provides an HTTP API with JSON responses for managing a running server.
+type admin struct {
+	s     *Server
+	token string
+	mux   *http.ServeMux
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+type adminLogLevel struct {
+	Level    string     `json:"level"`
+	Override bool       `json:"override"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+type adminLogLevelRequest struct {
+	Level   *int   `json:"level"`
+	Timeout string `json:"timeout"`
+}
+
+type adminIntercept struct {
+	Channels []string `json:"channels"`
+	Clients  []uint64 `json:"clients"`
+}
+
+type adminInterceptRequest struct {
+	Channel string `json:"channel"`
+	Client  uint64 `json:"client"`
+}
+
+type adminRecord struct {
+	Channels []string `json:"channels"`
+}
+
+type adminRecordRequest struct {
+	Channel string `json:"channel"`
+}
+
+type adminClient struct {
+	ID             uint64    `json:"id"`
+	RemoteAddr     string    `json:"remote_addr"`
+	ChannelHash    string    `json:"channel_hash"`
+	ConnectionType string    `json:"connection_type"`
+	CertSubject    string    `json:"cert_subject,omitempty"`
+	Connected      time.Time `json:"connected"`
+	LastRead       time.Time `json:"last_read"`
+	Held           bool      `json:"held,omitempty"`
+}
+
+// newAdmin creates an admin API for the server.
+// If token is not empty, requests must provide it as a bearer token in the Authorization header.
+func newAdmin(s *Server, token string) *admin {
+	a := &admin{
+		s:     s,
+		token: token,
+		mux:   http.NewServeMux(),
+	}
+	a.mux.HandleFunc("/loglevel", a.handleLogLevel)
+	a.mux.HandleFunc("/intercept", a.handleIntercept)
+	a.mux.HandleFunc("/record", a.handleRecord)
+	a.mux.HandleFunc("/cert", a.handleCert)
+	a.mux.HandleFunc("/clients", a.handleClients)
+	return a
+}
+
+// Listen creates the listener of the admin API for the provided listen address, which must then be served with Serve.
+// Unless an admin token is set, the listener must be on a loopback address.
+func (a *admin) Listen(aAddr string) (net.Listener, error) {
+	ln, err := a.s.socket(adminSocketPrefix+aAddr, func() (net.Listener, error) {
+		return net.Listen("tcp", aAddr)
+	})
+	if err != nil {
+		a.s.l.Errorf("Admin API listener error on %s: %s\n", aAddr, err)
+		return nil, err
+	}
+	if tcpAddr, ok := ln.Addr().(*net.TCPAddr); ok && !tcpAddr.IP.IsLoopback() && a.token == "" {
+		ln.Close()
+		a.s.l.Errorf("Admin API listener error on %s: %s\n", aAddr, ErrAdminToken)
+		return nil, ErrAdminToken
+	}
+	return ln, nil
+}
+
+// Serve serves the admin API on a listener created by Listen.
+func (a *admin) Serve(ln net.Listener) error {
+	srv := &http.Server{
+		Handler:           a,
+		ReadHeaderTimeout: AdminTimeout,
+	}
+	a.s.l.Infof("Admin API started at listening address %s\n", ln.Addr())
+	err := srv.Serve(ln)
+	a.s.l.Errorf("Admin API stopped at listening address %s: %s\n", ln.Addr(), err)
+	return err
+}
+
+// ServeHTTP implements http.Handler for admin.
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" {
+		want := "Bearer " + a.token
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+			a.s.l.Warnf("Unauthorized admin API request from %s\n", r.RemoteAddr)
+			writeJSON(w, http.StatusUnauthorized, adminError{"unauthorized"})
+			return
+		}
+	}
+	a.s.l.Debugf("Admin API request from %s: %s %s\n", r.RemoteAddr, r.Method, r.URL.Path)
+	a.mux.ServeHTTP(w, r)
+}
+
+// handleLogLevel reports the log level on GET, overrides it on PUT or POST, and restores it on DELETE.
+func (a *admin) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req adminLogLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Level == nil {
+			writeJSON(w, http.StatusBadRequest, adminError{"invalid_parameters"})
+			return
+		}
+		timeout := logLevelTimeout
+		if req.Timeout != "" {
+			d, err := time.ParseDuration(req.Timeout)
+			if err != nil || d < 0 {
+				writeJSON(w, http.StatusBadRequest, adminError{"invalid_timeout"})
+				return
+			}
+			timeout = d
+		}
+		a.s.l.SetLevel(*req.Level, timeout)
+	case http.MethodDelete:
+		a.s.l.ResetLevel()
+		a.s.l.Infof("Log levels restored by admin API request from %s\n", r.RemoteAddr)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{"method_not_allowed"})
+		return
+	}
+
+	resp := adminLogLevel{
+		Level: a.s.l.Level().String(),
+	}
+	if _, expires, ok := a.s.l.LevelOverride(); ok {
+		resp.Override = true
+		if !expires.IsZero() {
+			resp.Expires = &expires
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleIntercept reports the intercepted channels and clients on GET,
+// adds a channel or client on PUT or POST, and removes one on DELETE.
+func (a *admin) handleIntercept(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+		var req adminInterceptRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Channel == "" && req.Client == 0) {
+			writeJSON(w, http.StatusBadRequest, adminError{"invalid_parameters"})
+			return
+		}
+		enable := r.Method != http.MethodDelete
+		if req.Channel != "" {
+			a.s.interceptChannel(req.Channel, enable)
+		}
+		if req.Client != 0 {
+			a.s.interceptClient(req.Client, enable)
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{"method_not_allowed"})
+		return
+	}
+
+	var resp adminIntercept
+	resp.Channels, resp.Clients = a.s.intercept.list()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleRecord reports the recorded channels on GET,
+// starts recording a channel on PUT or POST, and stops recording it on DELETE.
+func (a *admin) handleRecord(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+		var req adminRecordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Channel == "" {
+			writeJSON(w, http.StatusBadRequest, adminError{"invalid_parameters"})
+			return
+		}
+		a.s.recordChannel(req.Channel, r.Method != http.MethodDelete)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{"method_not_allowed"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, adminRecord{a.s.record.list()})
+}
+
+// handleCert reports information about the current certificate, including its fingerprint, on GET.
+func (a *admin) handleCert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{"method_not_allowed"})
+		return
+	}
+	cert := a.s.certs.Load()
+	if cert.Leaf == nil {
+		writeJSON(w, http.StatusInternalServerError, adminError{"invalid_certificate"})
+		return
+	}
+	writeJSON(w, http.StatusOK, newCertInfo(cert.Leaf))
+}
+
+// handleClients reports the clients in channels on GET, sorted by ID.
+func (a *admin) handleClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{"method_not_allowed"})
+		return
+	}
+	clients := make([]adminClient, 0)
+	a.s.mu.RLock()
+	for _, ch := range a.s.channels {
+		for c := range ch {
+			clients = append(clients, adminClient{
+				ID:             c.id,
+				RemoteAddr:     c.addr,
+				ChannelHash:    channelHash(c.channel),
+				ConnectionType: c.connectionType,
+				CertSubject:    c.certSubject(),
+				Connected:      c.connectedTime,
+				LastRead:       c.lastReadTime(),
+				Held:           c.isHeld(),
+			})
+		}
+	}
+	a.s.mu.RUnlock()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+	writeJSON(w, http.StatusOK, clients)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -2,18 +2,27 @@ package main
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/fs"
 	"math/big"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -28,80 +37,251 @@ func serialNumber() *big.Int {
 	return serialNum
 }
 
-func genCert(writeFile bool) (tls.Certificate, error) {
+// genCert generates a certificate for the names set in -certdns and -certip.
+// If -certca is set, the certificate is signed by that certificate authority, which is generated if it doesn't exist.
+// Otherwise, the certificate is self-signed.
+// If priv is nil, a new private key of the type set in -certkey is generated.
+func genCert(writeFile bool, priv crypto.Signer) (tls.Certificate, error) {
 	blankCert := tls.Certificate{}
-	ca := &x509.Certificate{
+	dnsNames, ips, err := certNames()
+	if err != nil {
+		return blankCert, err
+	}
+	if priv == nil {
+		priv, err = genKey(certificateKeyType)
+		if err != nil {
+			return blankCert, err
+		}
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
 		SerialNumber: serialNumber(),
 		Subject: pkix.Name{
 			Country:      []string{"US"},
 			Organization: []string{"NVDARemote Server"},
 			CommonName:   "Root CA",
 		},
-		DNSNames:              []string{"localhost"},
-		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
-		NotBefore:             time.Now().Add(-10 * time.Second),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+		NotBefore:             now.Add(-10 * time.Second),
+		NotAfter:              now.Add(certificateValidity),
 		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  true,
+		SubjectKeyId:          keyID(priv.Public()),
 	}
-	priv, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	parent, signer := tmpl, priv
+	if certificateCAPath == "" {
+		tmpl.AuthorityKeyId = tmpl.SubjectKeyId
+	} else {
+		caCert, caKey, err := loadCA()
+		if err != nil {
+			return blankCert, err
+		}
+		tmpl.Subject.CommonName = "NVDARemote Server"
+		if len(dnsNames) > 0 {
+			tmpl.Subject.CommonName = dnsNames[0]
+		}
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		if _, ok := priv.(*rsa.PrivateKey); ok {
+			tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+		}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IsCA = false
+		tmpl.AuthorityKeyId = caCert.SubjectKeyId
+		// Clients that trust the certificate authority don't trust certificates it signed beyond its own expiry.
+		if tmpl.NotAfter.After(caCert.NotAfter) {
+			logger.Warnf("Certificate authority %s expires at %s, before -certvalidity, so the generated certificate expires then.\n", certificateCAPath, caCert.NotAfter.Format(time.RFC3339))
+			tmpl.NotAfter = caCert.NotAfter
+		}
+		parent, signer = caCert, caKey
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, parent, priv.Public(), signer)
 	if err != nil {
 		return blankCert, err
 	}
-	pubKeyBytes, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
-	keyID := sha1.Sum(pubKeyBytes)
-	ca.SubjectKeyId = keyID[:]
-	ca.AuthorityKeyId = keyID[:]
-	caBytes, cerr := x509.CreateCertificate(rand.Reader, ca, ca, &priv.PublicKey, priv)
-	if cerr != nil {
-		return blankCert, cerr
-	}
 
-	certPEM := new(bytes.Buffer)
-	err = pem.Encode(certPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: caBytes,
-	})
+	certPEM, keyPEM, err := encodeCert(certDER, priv)
 	if err != nil {
 		return blankCert, err
 	}
 
-	mpk, merr := x509.MarshalPKCS8PrivateKey(priv)
-	if merr != nil {
-		return blankCert, merr
+	if writeFile {
+		_ = genCertFile(certificatePath, keyPath, certPEM, keyPEM)
 	}
 
-	certPrivKeyPEM := new(bytes.Buffer)
-	err = pem.Encode(certPrivKeyPEM, &pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: mpk,
-	})
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// loadCA loads the certificate authority from -certca and its private key from -certcakey,
+// decrypted with the passphrase from -certcakeypassfile or -certcakeypassenv if it is encrypted.
+// If the certificate authority doesn't exist, it is generated and written to those files.
+func loadCA() (*x509.Certificate, crypto.Signer, error) {
+	if _, err := os.Stat(certificateCAPath); errors.Is(err, fs.ErrNotExist) {
+		return genCA()
+	}
+	pair, err := loadKeyPair(certificateCAPath, certificateCAKeyPath, caKeyPassFile, caKeyPassEnv)
 	if err != nil {
-		return blankCert, err
+		return nil, nil, err
+	}
+	caCert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
 	}
+	caKey, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !caCert.IsCA {
+		return nil, nil, fmt.Errorf("%w: %s", ErrCertNotCA, certificateCAPath)
+	}
+	return caCert, caKey, nil
+}
 
-	if writeFile {
-		_ = genCertFile(certificatePath, certPEM.Bytes(), certPrivKeyPEM.Bytes())
+// genCA generates a certificate authority, writing the certificate to -certca and the private key to -certcakey.
+func genCA() (*x509.Certificate, crypto.Signer, error) {
+	logger.Infof("Generating certificate authority %s\n", certificateCAPath)
+	priv, err := genKey(certificateKeyType)
+	if err != nil {
+		return nil, nil, err
 	}
+	now := time.Now()
+	id := keyID(priv.Public())
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject: pkix.Name{
+			Country:      []string{"US"},
+			Organization: []string{"NVDARemote Server"},
+			CommonName:   "NVDARemote Server Local CA",
+		},
+		NotBefore:             now.Add(-10 * time.Second),
+		NotAfter:              now.Add(CertCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          id,
+		AuthorityKeyId:        id,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM, keyPEM, err := encodeCert(certDER, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The key is written first, so a certificate authority is never left without its key.
+	if err := fileRewrite(certificateCAKeyPath, keyPEM, 0o600); err != nil {
+		return nil, nil, err
+	}
+	if err := fileRewrite(certificateCAPath, certPEM, 0o644); err != nil {
+		return nil, nil, err
+	}
+	caCert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	return caCert, priv, nil
+}
+
+// genKey generates a private key of the given type.
+func genKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case CertKeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case CertKeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case CertKeyECDSAP521:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case CertKeyEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	case CertKeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case CertKeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrCertKeyType, keyType)
+	}
+}
+
+// keyID returns the subject key identifier of a public key.
+func keyID(pub crypto.PublicKey) []byte {
+	pubKeyBytes, _ := x509.MarshalPKIXPublicKey(pub)
+	id := sha1.Sum(pubKeyBytes)
+	return id[:]
+}
 
-	return tls.X509KeyPair(certPEM.Bytes(), certPrivKeyPEM.Bytes())
+// certNames returns the DNS names and IP addresses set in -certdns and -certip.
+func certNames() ([]string, []net.IP, error) {
+	var dnsNames []string
+	var ips []net.IP
+	for _, name := range strings.Split(certificateDNSNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	for _, s := range strings.Split(certificateIPs, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("%w: %s is not an IP address", ErrCertName, s)
+		}
+		ips = append(ips, ip)
+	}
+	if len(dnsNames) == 0 && len(ips) == 0 {
+		return nil, nil, fmt.Errorf("%w: at least one DNS name or IP address is required", ErrCertName)
+	}
+	return dnsNames, ips, nil
 }
 
-func genCertFile(file string, cert, key []byte) error {
-	logger.Debugf("Attempting to write certificate to file %s\n", file)
-	err := fileRewrite(file, append(key, cert...))
+// encodeCert encodes a certificate and its private key in .pem format.
+func encodeCert(certDER []byte, priv crypto.Signer) (certPEM, keyPEM []byte, err error) {
+	mpk, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certDER,
+	})
+	keyPEM = pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: mpk,
+	})
+	return certPEM, keyPEM, nil
+}
+
+// genCertFile writes a generated certificate to file, and its private key to keyFile.
+// If keyFile is empty, the private key is written to file after the certificate.
+func genCertFile(file, keyFile string, cert, key []byte) error {
+	if keyFile == "" {
+		logger.Debugf("Attempting to write certificate to file %s\n", file)
+		err := fileRewrite(file, append(cert, key...), 0o600)
+		if err != nil {
+			logger.Errorf("Failed to write certificate.\n%s\n", err)
+			return err
+		}
+		logger.Debugf("Certificate and key successfully written to %s\n", file)
+		return nil
+	}
+	logger.Debugf("Attempting to write certificate to file %s and key to file %s\n", file, keyFile)
+	// The key is written first, so a certificate is never left without its key.
+	err := fileRewrite(keyFile, key, 0o600)
+	if err == nil {
+		err = fileRewrite(file, cert, 0o644)
+	}
 	if err != nil {
 		logger.Errorf("Failed to write certificate.\n%s\n", err)
 		return err
 	}
-	logger.Debugf("Certificate and key successfully written to %s\n", file)
+	logger.Debugf("Certificate successfully written to %s, and key to %s\n", file, keyFile)
 	return nil
 }
 
-func fileRewrite(file string, data []byte) error {
-	w, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+func fileRewrite(file string, data []byte, perm os.FileMode) error {
+	w, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return fmt.Errorf("unable to create or open the file %s\n%w", file, err)
 	}
@@ -117,6 +297,98 @@ func fileRewrite(file string, data []byte) error {
 	return nil
 }
 
+// loadKeyPair loads a certificate chain from certFile and its private key from keyFile, both in .pem format.
+// If keyFile is empty, the private key is loaded from certFile.
+// An encrypted PKCS#8 private key is decrypted with the passphrase read from passFile or the environment variable passEnv.
+func loadKeyPair(certFile, keyFile, passFile, passEnv string) (tls.Certificate, error) {
+	if keyFile == "" {
+		keyFile = certFile
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	for rest := keyPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "ENCRYPTED PRIVATE KEY" {
+			continue
+		}
+		passphrase, err := keyPassphrase(passFile, passEnv)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		der, err := decryptPKCS8(block.Bytes, passphrase)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("%s: %w", keyFile, err)
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		break
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// keyPassphrase returns the passphrase for an encrypted private key, read from passFile or the environment variable passEnv.
+func keyPassphrase(passFile, passEnv string) ([]byte, error) {
+	if passFile != "" {
+		data, err := os.ReadFile(passFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	if passEnv != "" {
+		if v, ok := os.LookupEnv(passEnv); ok {
+			return []byte(v), nil
+		}
+	}
+	return nil, ErrKeyNoPassphrase
+}
+
+// certFiles returns the files a certificate and its private key are loaded from.
+func certFiles(certFile, keyFile string) []string {
+	if keyFile == "" {
+		return []string{certFile}
+	}
+	return []string{certFile, keyFile}
+}
+
+// loadCertFile loads the certificate chain at certFile and the private key at keyFile, and parses the leaf certificate.
+// If keyFile is empty, the private key is loaded from certFile.
+func loadCertFile(certFile, keyFile string) (tls.Certificate, error) {
+	cert, err := loadKeyPair(certFile, keyFile, keyPassFile, keyPassEnv)
+	if err != nil {
+		return cert, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
+
+// checkCertValidity returns ErrCertNotValid if cert is expired or not yet valid.
+// NVDA trusts certificates by fingerprint regardless of their validity,
+// so this only keeps a working certificate from being replaced by one that isn't valid.
+func checkCertValidity(cert *x509.Certificate) error {
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("%w: valid from %s to %s", ErrCertNotValid, cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// certFingerprint returns the SHA-256 fingerprint of a certificate as lowercase hexadecimal,
+// the format shown by NVDA when asking to trust a certificate.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
 // loadCert loads a certificate from a file or self-signed certificate.
 func loadCert() (tls.Certificate, error) {
 	var certificate tls.Certificate
@@ -124,15 +396,74 @@ func loadCert() (tls.Certificate, error) {
 
 	if !certificateGen {
 		logger.Debugf("Attempting to load certificate from %s\n", certificatePath)
-		certificate, certerr = tls.LoadX509KeyPair(certificatePath, certificatePath)
+		certificate, certerr = loadCertFile(certificatePath, keyPath)
 	} else {
-		logger.Debugf("Attempting to generate self-signed certificate and load into memory.\n")
-		certificate, certerr = genCert(certificateWrite)
+		logger.Debugf("Attempting to generate a certificate and load it into memory.\n")
+		certificate, certerr = genCert(certificateWrite, nil)
 	}
 	if certerr == nil {
 		logger.Debugf("Certificate successfully loaded.\n")
+		if leaf, err := x509.ParseCertificate(certificate.Certificate[0]); err == nil {
+			logger.Infof("Certificate fingerprint (SHA-256): %s, expires at %s.\n", certFingerprint(leaf), leaf.NotAfter.Format(time.RFC3339))
+			if err := checkCertValidity(leaf); err != nil {
+				logger.Warnf("The certificate will be used, but clients that check its validity will refuse it: %v\n", err)
+			}
+		}
 	} else {
 		logger.Errorf("Unable to load certificate: %v\n", certerr)
 	}
 	return certificate, certerr
 }
+
+// certInfo describes a certificate.
+type certInfo struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dns_names"`
+	IPAddresses []string  `json:"ip_addresses"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	KeyType     string    `json:"key_type"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+func newCertInfo(cert *x509.Certificate) certInfo {
+	ci := certInfo{
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		DNSNames:    cert.DNSNames,
+		IPAddresses: make([]string, 0, len(cert.IPAddresses)),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		KeyType:     keyType(cert.PublicKey),
+		Fingerprint: certFingerprint(cert),
+	}
+	if ci.DNSNames == nil {
+		ci.DNSNames = []string{}
+	}
+	for _, ip := range cert.IPAddresses {
+		ci.IPAddresses = append(ci.IPAddresses, ip.String())
+	}
+	return ci
+}
+
+// String returns the certificate information as text, one field per line.
+func (ci certInfo) String() string {
+	return fmt.Sprintf("Subject: %s\nIssuer: %s\nDNS names: %s\nIP addresses: %s\nValid from: %s\nValid until: %s\nKey type: %s\nSHA-256 fingerprint: %s\n",
+		ci.Subject, ci.Issuer, strings.Join(ci.DNSNames, ", "), strings.Join(ci.IPAddresses, ", "),
+		ci.NotBefore.Format(time.RFC3339), ci.NotAfter.Format(time.RFC3339), ci.KeyType, ci.Fingerprint)
+}
+
+// keyType returns a description of the algorithm and size of a public key.
+func keyType(pub any) string {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case *rsa.PublicKey:
+		return "RSA " + strconv.Itoa(k.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
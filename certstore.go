@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certStore holds the certificates used for new connections.
+// The default certificate is used unless the client requests a host with its own certificate, set with -vhost.
+// The certificates can be replaced while the server is running,
+// and connections that are already established are not affected.
+type certStore struct {
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	hosts map[string]*tls.Certificate
+	l     *Logger
+	acme  *autocert.Manager
+}
+
+// newCertStore creates a certStore holding cert.
+// If acme is not nil, it provides certificates for the hosts it manages.
+func newCertStore(cert tls.Certificate, acme *autocert.Manager, l *Logger) *certStore {
+	cs := &certStore{
+		hosts: make(map[string]*tls.Certificate),
+		l:     l,
+		acme:  acme,
+	}
+	cs.Store(cert)
+	return cs
+}
+
+// GetCertificate returns the certificate for a new connection, for use as tls.Config.GetCertificate.
+func (cs *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert, ok, err := cs.getACMECertificate(hello); ok {
+		return cert, err
+	}
+	if host, ok := cs.matchHost(hello.ServerName); ok {
+		cs.mu.RLock()
+		defer cs.mu.RUnlock()
+		return cs.hosts[host], nil
+	}
+	return cs.Load(), nil
+}
+
+// matchHost returns the host with its own certificate that serverName belongs to.
+// A host such as *.example.com matches a single label in place of the asterisk.
+func (cs *certStore) matchHost(serverName string) (string, bool) {
+	if serverName == "" {
+		return "", false
+	}
+	serverName = strings.ToLower(serverName)
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if _, ok := cs.hosts[serverName]; ok {
+		return serverName, true
+	}
+	if i := strings.IndexByte(serverName, '.'); i > 0 {
+		wildcard := "*" + serverName[i:]
+		if _, ok := cs.hosts[wildcard]; ok {
+			return wildcard, true
+		}
+	}
+	return "", false
+}
+
+// Load returns the current certificate.
+func (cs *certStore) Load() *tls.Certificate {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.cert
+}
+
+// Store replaces the default certificate.
+// The leaf certificate is parsed if it was not already.
+func (cs *certStore) Store(cert tls.Certificate) {
+	cs.StoreHost("", cert)
+}
+
+// StoreHost replaces the certificate for a host.
+// If host is empty, the default certificate is replaced.
+func (cs *certStore) StoreHost(host string, cert tls.Certificate) {
+	if cert.Leaf == nil && len(cert.Certificate) > 0 {
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if host == "" {
+		cs.cert = &cert
+	} else {
+		cs.hosts[host] = &cert
+	}
+}
+
+// monitor checks the expiry of the current certificates every CertCheckInterval, and never returns.
+// A warning is logged when a certificate expires within warn.
+// If generated is true, the default certificate is generated again when it expires within renew,
+// using the same private key if keepKey is true.
+// The certificates of virtual hosts are loaded from files, so they are only checked for expiry.
+func (cs *certStore) monitor(l *Logger, warn, renew time.Duration, generated, keepKey bool) {
+	for {
+		cs.checkExpiry(l, "", warn, renew, generated, keepKey)
+		for _, host := range cs.hostNames() {
+			cs.checkExpiry(l, host, warn, renew, false, false)
+		}
+		time.Sleep(CertCheckInterval)
+	}
+}
+
+// hostNames returns the hosts with their own certificate.
+func (cs *certStore) hostNames() []string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	hosts := make([]string, 0, len(cs.hosts))
+	for host := range cs.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// LoadHost returns the current certificate for a host.
+// If host is empty, the default certificate is returned.
+func (cs *certStore) LoadHost(host string) *tls.Certificate {
+	if host == "" {
+		return cs.Load()
+	}
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.hosts[host]
+}
+
+// checkExpiry checks the expiry of the certificate for a host, or of the default certificate if host is empty.
+func (cs *certStore) checkExpiry(l *Logger, host string, warn, renew time.Duration, generated, keepKey bool) {
+	cert := cs.LoadHost(host)
+	if cert == nil || cert.Leaf == nil {
+		return
+	}
+	name := "Certificate"
+	if host != "" {
+		name = "Certificate for " + host
+	}
+	remaining := time.Until(cert.Leaf.NotAfter)
+
+	if generated && remaining < renew {
+		l.Infof("%s expires at %s, generating a new certificate.\n", name, cert.Leaf.NotAfter.Format(time.RFC3339))
+		var key crypto.Signer
+		if keepKey {
+			key, _ = cert.PrivateKey.(crypto.Signer)
+		}
+		newCert, err := genCert(certificateWrite, key)
+		if err != nil {
+			l.Errorf("Unable to generate a new certificate: %v\n", err)
+			return
+		}
+		cs.StoreHost(host, newCert)
+		leaf := cs.LoadHost(host).Leaf
+		l.Infof("New certificate generated. Fingerprint: %s, expires at %s.\n", certFingerprint(leaf), leaf.NotAfter.Format(time.RFC3339))
+		// The fingerprint covers the whole certificate, so it changes even if the private key was kept.
+		if certificateCAPath == "" {
+			l.Warnf("The certificate fingerprint changed from %s to %s. Clients that trusted the previous certificate must trust the new one before they can connect.\n", certFingerprint(cert.Leaf), certFingerprint(leaf))
+		}
+		return
+	}
+
+	if remaining <= 0 {
+		l.Errorf("%s expired at %s.\n", name, cert.Leaf.NotAfter.Format(time.RFC3339))
+	} else if remaining < warn {
+		l.Warnf("%s expires at %s, in %s.\n", name, cert.Leaf.NotAfter.Format(time.RFC3339), remaining.Round(time.Minute))
+	}
+}
+
+// watch checks the certificate file and key file of a host every interval, and never returns.
+// When either of the files change, the certificate is loaded and used for new connections.
+// If the new certificate can't be loaded, the current certificate is kept.
+// If host is empty, the default certificate is watched.
+func (cs *certStore) watch(l *Logger, host, certFile, keyFile string, interval time.Duration) {
+	paths := certFiles(certFile, keyFile)
+	last, _ := statFiles(paths)
+	var failed []os.FileInfo
+	statFailed := false
+	for {
+		time.Sleep(interval)
+		info, err := statFiles(paths)
+		if err != nil {
+			if !statFailed {
+				l.Errorf("Unable to check certificate file: %v\n", err)
+				statFailed = true
+			}
+			continue
+		}
+		statFailed = false
+		if filesUnchanged(info, last) || filesUnchanged(info, failed) {
+			continue
+		}
+		cert, err := loadCertFile(certFile, keyFile)
+		if err == nil {
+			err = checkCertValidity(cert.Leaf)
+		}
+		if err != nil {
+			l.Errorf("Certificate file %s changed, but could not be loaded. The current certificate will be kept.\n%v\n", strings.Join(paths, ", "), err)
+			failed = info
+			continue
+		}
+		cs.StoreHost(host, cert)
+		last, failed = info, nil
+		l.Infof("Certificate reloaded from %s. Fingerprint: %s, expires at %s.\n", strings.Join(paths, ", "), certFingerprint(cert.Leaf), cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// statFiles returns information about each of the files in paths.
+func statFiles(paths []string) ([]os.FileInfo, error) {
+	info := make([]os.FileInfo, len(paths))
+	for i, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		info[i] = fi
+	}
+	return info, nil
+}
+
+// filesUnchanged reports whether each file in a has the same size and modification time as the same file in b.
+func filesUnchanged(a, b []os.FileInfo) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Size() != b[i].Size() || !a[i].ModTime().Equal(b[i].ModTime()) {
+			return false
+		}
+	}
+	return true
+}
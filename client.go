@@ -2,40 +2,70 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"io"
 	"net"
+	"os"
 	"runtime/debug"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Conn is the connection of a client, carrying newline-delimited protocol data.
+// TCP and TLS connections implement it with net.Conn, and WebSocket connections with wsConn,
+// which carries one line of protocol data in each message.
+type Conn interface {
+	io.ReadWriteCloser
+	RemoteAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
 // Client is a connected client for the NVDA Remote Access server.
 type Client struct {
-	conn           net.Conn
-	closed         bool
-	mu             sync.RWMutex
-	writeDuration  time.Duration
-	connectedTime  time.Time
-	id             uint
-	srv            *Server
-	channel        string
-	connectionType string
-	version        int
-	once           sync.Once
-	w              *writech
-}
-
-// NewClient creates a new client with the given net.Conn interface and server.
-func NewClient(conn net.Conn, s *Server) *Client {
-	s.l.Warnf("Client %s connected.\n", conn.RemoteAddr())
-	return &Client{
+	conn             Conn
+	addr             string
+	closed           bool
+	mu               sync.RWMutex
+	writeDuration    time.Duration
+	connectedTime    time.Time
+	lastRead         atomic.Int64
+	resumeToken      string
+	resumeTimer      *time.Timer
+	resumeBuf        [][]byte
+	held             bool
+	dead             bool
+	resumeOverflowed bool
+	id               uint64
+	srv              *Server
+	channel          string
+	namespace        string
+	isolated         bool
+	cert             *x509.Certificate
+	connectionType   string
+	version          int
+	once             sync.Once
+	w                *writech
+}
+
+// NewClient creates a new client with the given Conn interface and server.
+// The address of the client is taken from conn, which for connections from a proxy is the address the proxy reports.
+func NewClient(conn Conn, s *Server) *Client {
+	addr := conn.RemoteAddr().String()
+	s.l.With(LogFields{RemoteAddr: addr, Event: EventClientConnected}).Warnf("Client %s connected.\n", addr)
+	c := &Client{
 		conn:          conn,
+		addr:          addr,
 		srv:           s,
 		connectedTime: time.Now(),
 	}
+	c.lastRead.Store(c.connectedTime.UnixNano())
+	return c
 }
 
 // Close closes the client connection and any associated goroutines.
@@ -44,15 +74,24 @@ func (c *Client) Close() {
 		c.mu.Lock()
 		c.closed = true
 		c.mu.Unlock()
-		if c.channel != "" {
+		if c.channel != "" && !c.srv.holdClient(c) {
 			c.srv.removeClient(c)
 		}
 		c.conn.Close()
 		c.w.Close()
-		c.srv.l.Warnf("Client %s disconnected. Longest write duration was %s. Client was connected for %s\n", c.value(), c.readWriteDuration(), c.connectedDuration())
+		c.log().Event(EventClientDisconnected).Warnf("Client %s disconnected. Longest write duration was %s. Client was connected for %s\n", c.value(), c.readWriteDuration(), c.connectedDuration())
 	})
 }
 
+// disconnect closes the connection of the client, so that its handler stops and closes the client.
+// Unlike Close, it can be called before the handler has started.
+func (c *Client) disconnect() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.conn.Close()
+}
+
 // AsMap returns the client id and connection type as an Msg type for encoding to a JSON value.
 func (c *Client) AsMap() Msg {
 	return Msg{
@@ -61,12 +100,35 @@ func (c *Client) AsMap() Msg {
 	}
 }
 
+// webhookEvent returns a webhook event of the given type describing the client.
+func (c *Client) webhookEvent(event string) webhookEvent {
+	return webhookEvent{
+		Event:          event,
+		ChannelHash:    channelHash(c.channel),
+		ClientID:       c.id,
+		ConnectionType: c.connectionType,
+		RemoteAddr:     c.addr,
+	}
+}
+
+// log returns a LogEntry with the fields of the client attached.
+// If redaction is enabled, the channel is identified by its hash.
+func (c *Client) log() LogEntry {
+	return c.srv.l.With(LogFields{
+		ClientID:       c.id,
+		RemoteAddr:     c.addr,
+		Channel:        c.srv.redact.channel(c.channel),
+		ConnectionType: c.connectionType,
+		CertSubject:    c.certSubject(),
+	})
+}
+
 // SendMsg decodes Msg and sends it to the client if it's valid JSON.
 // If the decoded Msg is not valid JSON, an error will be returned and no data will be sent.
 func (c *Client) SendMsg(msg Msg) {
 	line, err := json.Marshal(msg)
 	if err != nil {
-		c.srv.l.Errorf("Invalid data type, failed to send Msg type to client %s: %v\n", c.value(), err)
+		c.log().Errorf("Invalid data type, failed to send Msg type to client %s: %v\n", c.value(), err)
 		return
 	}
 	line = append(line, Delimiter)
@@ -76,6 +138,9 @@ func (c *Client) SendMsg(msg Msg) {
 // SendLine sends the given line to the client.
 // Upon an encountered error, the clients connection is closed, disconnecting it from the server.
 func (c *Client) SendLine(line []byte) {
+	if c.bufferLine(line) {
+		return
+	}
 	if err := c.w.Write(line); err != nil {
 		c.Close()
 	}
@@ -89,20 +154,34 @@ func (c *Client) isClosed() bool {
 
 func (c *Client) handler() {
 	buffer := bufio.NewReaderSize(c.conn, ReadBufSize)
-	c.srv.l.Debugf("Read buffer created for client %s: size %d.\n", c.value(), ReadBufSize)
+	c.log().Debugf("Read buffer created for client %s: size %d.\n", c.value(), ReadBufSize)
 	c.w = newWritech(c)
 	defer c.Close()
 	defer c.panicCatch(recover())
+	if vhostIsolate || c.srv.clientAuth != nil {
+		if err := c.handshake(); err != nil {
+			c.log().Errorf("TLS handshake error from client %s: %v\n", c.value(), err)
+			return
+		}
+	}
 	for {
+		c.refreshReadDeadline()
 		line, err := buffer.ReadSlice(Delimiter)
 		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
-			if !errors.Is(err, io.EOF) && !c.isClosed() {
-				c.srv.l.Errorf("Read error from client %s: %v\n", c.value(), err)
+			if errors.Is(err, os.ErrDeadlineExceeded) && !c.isClosed() {
+				c.markDead()
+				c.log().Warnf("Client %s sent nothing for %s, disconnecting.\n", c.value(), pingTimeout)
+			} else if isDeadPeer(err) && !c.isClosed() {
+				c.markDead()
+				c.log().Warnf("Client %s stopped responding, disconnecting: %v\n", c.value(), err)
+			} else if !errors.Is(err, io.EOF) && !c.isClosed() {
+				c.log().Errorf("Read error from client %s: %v\n", c.value(), err)
 			}
 			return
 		}
+		c.lastRead.Store(time.Now().UnixNano())
 
-		c.srv.l.Interceptf("Received data from client %s\n%s\n", c.value(), line)
+		c.interceptData("Received data from", line)
 
 		if c.channel != "" {
 			c.handleChannel(line)
@@ -111,32 +190,78 @@ func (c *Client) handler() {
 
 		handshake := new(Handshake)
 		if err := json.Unmarshal(line, handshake); err != nil {
-			c.srv.l.Debugf("Invalid JSON data from client %s: %v\nData truncated: \"%s\"\n", c.value(), err, truncate(line, 12))
+			c.log().Debugf("Invalid JSON data from client %s: %v\nData truncated: \"%s\"\n", c.value(), err, truncate(line, 12))
 			return
 		}
 		if !c.handleHandshake(handshake) {
-			c.srv.l.Debugf("Invalid handshake from client %s\n", c.value())
+			c.log().Debugf("Invalid handshake from client %s\n", c.value())
 			return
 		}
 	}
 }
 
+// handshake completes the TLS handshake of the client, and records what the client sent during it.
+func (c *Client) handshake() error {
+	// Connections without TLS have an empty state, and are isolated in the namespace of clients without a virtual host.
+	var state tls.ConnectionState
+	switch conn := c.conn.(type) {
+	case *tls.Conn:
+		if err := conn.Handshake(); err != nil {
+			return err
+		}
+		state = conn.ConnectionState()
+	case *wsConn:
+		// The TLS handshake of a WebSocket connection is completed before it is upgraded.
+		if conn.tlsState != nil {
+			state = *conn.tlsState
+		}
+	}
+	if vhostIsolate {
+		c.setNamespace(state.ServerName)
+	}
+	if len(state.PeerCertificates) > 0 {
+		c.cert = state.PeerCertificates[0]
+		c.log().Warnf("Client %s authenticated with certificate \"%s\".\n", c.value(), c.certSubject())
+	}
+	return nil
+}
+
 func (c *Client) handleHandshake(handshake *Handshake) bool {
 	switch handshake.Type {
 	case TypeJoin:
 		if handshake.Channel == "" || handshake.ConnectionType == "" {
-			c.srv.l.Errorf("Client %s set empty Channel or connection type with %s type.\n", c.value(), TypeJoin)
+			c.log().Errorf("Client %s set empty Channel or connection type with %s type.\n", c.value(), TypeJoin)
 			c.SendMsg(MsgErr)
 			return false
 		}
-		c.channel = handshake.Channel
+		channel := c.qualifyChannel(handshake.Channel)
+		if !c.srv.clientAuth.allowed(c, channel) {
+			c.log().Warnf("Client %s with certificate \"%s\" is not allowed to join channel \"%s\".\n", c.value(), c.certSubject(), channel)
+			c.SendMsg(MsgNotAllowed)
+			return false
+		}
+		c.channel = channel
 		c.connectionType = handshake.ConnectionType
-		c.srv.addClient(c)
+		if err := c.srv.addClient(c); err != nil {
+			c.log().Errorf("Client %s could not join channel: %v\n", c.value(), err)
+			// The client is not in the channel, so it must not be removed from it when it's closed.
+			c.channel = ""
+			c.SendMsg(MsgErr)
+			return false
+		}
 		c.sendMotd()
 		return true
+	case TypeResume:
+		if handshake.ResumeToken == "" || !c.srv.resumeClient(c, handshake.ResumeToken) {
+			// The client can still join the channel as a new client on this connection.
+			c.log().Debugf("Client %s could not resume a session.\n", c.value())
+			c.SendMsg(MsgResumeFailed)
+			return true
+		}
+		return true
 	case TypeGenerateKey:
-		key := c.srv.generateKey()
-		c.srv.l.Debugf("Client %s generated key \"%s\"\n", c.value(), key)
+		key := c.srv.generateKey(c)
+		c.log().Event(EventKeyGenerated).Debugf("Client %s generated key \"%s\"\n", c.value(), key)
 		c.SendMsg(Msg{
 			"type": TypeGenerateKey,
 			"key":  key,
@@ -144,15 +269,15 @@ func (c *Client) handleHandshake(handshake *Handshake) bool {
 		return true
 	case TypeProtocolVersion:
 		if handshake.Version <= 0 {
-			c.srv.l.Debugf("Client %s is using invalid protocol version %d\n", c.value(), handshake.Version)
+			c.log().Debugf("Client %s is using invalid protocol version %d\n", c.value(), handshake.Version)
 			c.SendMsg(MsgErr)
 			return false
 		}
-		c.srv.l.Debugf("Client %s is using valid protocol version %d\n", c.value(), handshake.Version)
+		c.log().Debugf("Client %s is using valid protocol version %d\n", c.value(), handshake.Version)
 		c.version = handshake.Version
 		return true
 	default:
-		c.srv.l.Errorf("Client %s sent unknown type field: \"%s\"\n", c.value(), handshake.Type)
+		c.log().Errorf("Client %s sent unknown type field: \"%s\"\n", c.value(), handshake.Type)
 		c.SendMsg(MsgErr)
 		return false
 	}
@@ -165,7 +290,7 @@ func (c *Client) handleChannel(line []byte) {
 	}
 	var msgdec Msg
 	if err := json.Unmarshal(line, &msgdec); err != nil {
-		c.srv.l.Debugf("Invalid JSON data from client %s: %s\nData truncated: \"%s\"\n", c.value(), err, truncate(line, 4))
+		c.log().Debugf("Invalid JSON data from client %s: %s\nData truncated: \"%s\"\n", c.value(), err, truncate(line, 4))
 		c.srv.SendLineToChannel(c, line, true)
 		return
 	}
@@ -173,21 +298,14 @@ func (c *Client) handleChannel(line []byte) {
 }
 
 func (c *Client) sendMotd() {
-	var fmotd string
-	level := c.srv.l.level
+	fmotd := motd
 	display := motdAlwaysDisplay
-	if level >= LogLevelDebug {
+	if notice := c.interceptNotice(); notice != "" {
 		display = true
-		fmotd = "This server is running with its log level set to " + level.String() + ". Channel information "
-		if level >= LogLevelIntercept {
-			fmotd += "and protocol data"
-		}
-		fmotd += " is being intercepted."
+		fmotd = notice
 		if motd != "" {
 			fmotd += "\n" + motd
 		}
-	} else {
-		fmotd = motd
 	}
 
 	if fmotd == "" {
@@ -201,12 +319,30 @@ func (c *Client) sendMotd() {
 	})
 }
 
+// interceptNotice returns a notice for the client if information about its channel is being intercepted.
+// If nothing is intercepted, an empty string is returned.
+func (c *Client) interceptNotice() string {
+	level := c.srv.l.Level()
+	if level >= LogLevelDebug {
+		notice := "This server is running with its log level set to " + level.String() + ". Channel information"
+		if level >= LogLevelIntercept {
+			notice += " and protocol data"
+		}
+		notice += " is being intercepted."
+		return notice
+	}
+	if c.srv.channelIntercepted(c.channel) {
+		return InterceptNotice
+	}
+	return ""
+}
+
 func (c *Client) panicCatch(r any) {
 	if r == nil {
 		return
 	}
 	trace := debug.Stack()
-	c.srv.l.Errorf("PANIC CAUGHT: from client %s\n%v\nStack trace:\n%s\n", c.value(), r, trace)
+	c.log().Errorf("PANIC CAUGHT: from client %s\n%v\nStack trace:\n%s\n", c.value(), r, trace)
 }
 
 // storeDuration stores the elapsed duration if it’s greater.
@@ -220,7 +356,7 @@ func (c *Client) storeWriteDuration(start time.Time) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if elapsed > c.writeDuration {
-		c.srv.l.Debugf("New write duration stored for client %s: %s. Previous duration: %s\n", c.value(), elapsed, c.writeDuration)
+		c.log().Debugf("New write duration stored for client %s: %s. Previous duration: %s\n", c.value(), elapsed, c.writeDuration)
 		c.writeDuration = elapsed
 	}
 }
@@ -238,7 +374,7 @@ func (c *Client) connectedDuration() time.Duration {
 
 func (c *Client) value() string {
 	if c.id != 0 {
-		return strconv.FormatUint(uint64(c.id), 10)
+		return strconv.FormatUint(c.id, 10)
 	}
-	return c.conn.RemoteAddr().String()
+	return c.addr
 }
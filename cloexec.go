@@ -0,0 +1,10 @@
+//go:build !windows && !plan9
+
+package main
+
+import "syscall"
+
+// closeOnExec sets the close-on-exec flag of the file descriptor fd.
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
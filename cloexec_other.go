@@ -0,0 +1,6 @@
+//go:build windows || plan9
+
+package main
+
+// closeOnExec does nothing, as inherited sockets are not supported on these platforms.
+func closeOnExec(fd int) {}
@@ -7,3 +7,75 @@ var ErrNotTCP = errors.New("not tcp listener")
 
 // ErrNotTLS is returned if the TLS configuration of the server was nil, and the server cannot be a TLS listener.
 var ErrNotTLS = errors.New("not tls listener")
+
+// ErrSyslogUnsupported is returned if logging to syslog is requested on a platform without syslog.
+var ErrSyslogUnsupported = errors.New("syslog is not supported on this platform")
+
+// ErrAdminToken is returned if the admin API is not on a loopback address, and no admin token is set.
+var ErrAdminToken = errors.New("admin API is not on a loopback address and no admin token is set")
+
+// ErrRecordFormat is returned if a recording file is not in the expected format.
+var ErrRecordFormat = errors.New("invalid recording file")
+
+// ErrReplayAddr is returned if the address to replay a recording into is not valid.
+var ErrReplayAddr = errors.New("invalid replay address")
+
+// ErrFingerprint is returned if the certificate of a server does not have the expected fingerprint.
+var ErrFingerprint = errors.New("certificate fingerprint does not match")
+
+// ErrCertNotValid is returned if a certificate is expired or not yet valid.
+var ErrCertNotValid = errors.New("certificate is not currently valid")
+
+// ErrCertValidity is returned if generated certificates would not be valid for long enough to be used.
+var ErrCertValidity = errors.New("invalid certificate validity")
+
+// ErrCertKeyType is returned if the key type for a generated certificate is not supported.
+var ErrCertKeyType = errors.New("unsupported certificate key type")
+
+// ErrCertName is returned if a name for a generated certificate is not valid.
+var ErrCertName = errors.New("invalid certificate name")
+
+// ErrCertNotCA is returned if the certificate authority loaded for signing generated certificates is not a CA.
+var ErrCertNotCA = errors.New("certificate is not a certificate authority")
+
+// ErrKeyEncryption is returned if an encrypted private key uses an unsupported format or algorithm.
+var ErrKeyEncryption = errors.New("unsupported private key encryption")
+
+// ErrKeyPassphrase is returned if an encrypted private key could not be decrypted with the passphrase.
+var ErrKeyPassphrase = errors.New("unable to decrypt private key, the passphrase may be wrong")
+
+// ErrKeyNoPassphrase is returned if a private key is encrypted, but no passphrase was provided.
+var ErrKeyNoPassphrase = errors.New("private key is encrypted, but no passphrase was provided")
+
+// ErrVhost is returned if a virtual host is not valid.
+var ErrVhost = errors.New("invalid virtual host")
+
+// ErrIDStrategy is returned if the client ID strategy is unknown.
+var ErrIDStrategy = errors.New("unknown client ID strategy")
+
+// ErrClientID is returned if no ID could be given to a client joining a channel.
+var ErrClientID = errors.New("unable to assign client ID")
+
+// ErrClientAuth is returned if the client certificate settings are not valid.
+var ErrClientAuth = errors.New("invalid client certificate settings")
+
+// ErrTLSPolicy is returned if the TLS versions, cipher suites or curves are not valid.
+var ErrTLSPolicy = errors.New("invalid TLS policy")
+
+// ErrListenSpec is returned if a listening address or its options are not valid.
+var ErrListenSpec = errors.New("invalid listening address")
+
+// ErrNotLoopback is returned if a listener without TLS is not on a loopback address.
+var ErrNotLoopback = errors.New("listener without TLS is not on a loopback address")
+
+// ErrProxyHeader is returned if a connection from a trusted proxy does not start with a valid PROXY protocol header.
+var ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+// ErrListenFD is returned if a listening address uses a socket that was not passed to the server by systemd.
+var ErrListenFD = errors.New("socket not passed by systemd")
+
+// ErrUpgrade is returned if the server could not be upgraded to a new server process.
+var ErrUpgrade = errors.New("upgrade failed")
+
+// ErrWebSocket is returned if a WebSocket client violates the WebSocket protocol.
+var ErrWebSocket = errors.New("websocket protocol error")
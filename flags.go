@@ -2,30 +2,183 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
 )
 
+// stringList is a flag that can be provided multiple times.
+type stringList []string
+
+// String implements flag.Value for stringList.
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set implements flag.Value for stringList.
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 var (
-	addr              string
-	certificatePath   string
-	certificateGen    bool
-	certificateWrite  bool
-	sendOrigin        bool
-	motd              string
-	motdAlwaysDisplay bool
-	launch            bool
-	logLevel          int
+	addrs                 stringList
+	proxyTrusted          string
+	tlsMinVersion         string
+	tlsMaxVersion         string
+	tlsCiphers            string
+	tlsCurvePrefs         string
+	tlsTicketRotate       time.Duration
+	certificatePath       string
+	keyPath               string
+	keyPassFile           string
+	keyPassEnv            string
+	vhostSpecs            stringList
+	vhostIsolate          bool
+	clientCAPath          string
+	clientAuthMode        string
+	clientAllowRules      stringList
+	certificateGen        bool
+	certificateWrite      bool
+	certificateWarn       time.Duration
+	certificateRenew      time.Duration
+	certificateRenewKey   bool
+	certificateReload     time.Duration
+	certificateInfo       bool
+	certificateDNSNames   string
+	certificateIPs        string
+	certificateKeyType    string
+	certificateValidity   time.Duration
+	certificateCAPath     string
+	certificateCAKeyPath  string
+	caKeyPassFile         string
+	caKeyPassEnv          string
+	acmeHosts             stringList
+	acmeDirectoryURL      string
+	acmeCacheDir          string
+	acmeEmail             string
+	acmeRootCA            string
+	sendOrigin            bool
+	motd                  string
+	motdAlwaysDisplay     bool
+	launch                bool
+	drainTimeout          time.Duration
+	logLevel              int
+	logFormat             string
+	logFile               string
+	logFileLevel          int
+	logFileMaxSize        int
+	logFileMaxAge         time.Duration
+	logFileBackups        int
+	logSyslog             bool
+	logSyslogLevel        int
+	logLevelTimeout       time.Duration
+	adminAddr             string
+	adminToken            string
+	interceptChannels     stringList
+	interceptClients      stringList
+	interceptRedact       bool
+	interceptRedactFields string
+	recordChannels        stringList
+	recordDir             string
+	recordKey             bool
+	webhookURLs           stringList
+	webhookSecret         string
+	pingInterval          time.Duration
+	pingTimeout           time.Duration
+	resumeGrace           time.Duration
+	idStrategy            string
 )
 
 func FlagsInit() {
-	flag.StringVar(&addr, "addr", ":6837", "Provide the server with a listening address.")
-	flag.StringVar(&certificatePath, "cert", "cert.pem", "Provide the server with a certificate file to load, containing the private key and certificate in .pem format.")
+	flag.Var(&addrs, "addr", "Provide the server with a listening address. (default "+DefaultAddr+") The TLS settings of a listener can be changed with options after the address, such as :6837?tlsmin=1.3 or :6838?tlsciphers=TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, using the names of the -tls flags without the dash. An address starting with tcp://, such as tcp://127.0.0.1:6837, listens without TLS for use behind a proxy that terminates TLS, and must be a loopback address unless ?force=1 is added. An address starting with wss://, or ws:// for use behind a proxy, accepts WebSocket connections, at the path set with the path option, such as wss://:443?path=/remote. Browsers can be limited to pages at certain origins with the origins option, such as ?origins=https://example.org. An address starting with unix://, such as unix:///run/nvdaremote.sock?mode=0660&group=remote, listens on a Unix domain socket without TLS for local clients, with the permissions set by the mode and group options. With systemd socket activation, a socket passed by systemd is used with the fd option, set to its file descriptor number or its FileDescriptorName, such as ?fd=3 or wss://?fd=remote&path=/remote. If no address is provided, each socket passed by systemd is used as a TLS listener. Adding ?proxy=1 reads the address of clients from the PROXY protocol header sent by a proxy such as HAProxy. Can be provided multiple times.")
+	flag.StringVar(&proxyTrusted, "proxytrusted", "127.0.0.0/8,::1", "Provide a comma separated list of IP addresses and CIDR ranges of proxies that are trusted to send the PROXY protocol, on listeners with the proxy option, such as :6837?proxy=1. The option proxytrusted overrides this for a single listener.")
+	flag.StringVar(&tlsMinVersion, "tlsmin", "1.2", "Tell the server the minimum TLS version to accept, one of 1.0, 1.1, 1.2 or 1.3.")
+	flag.StringVar(&tlsMaxVersion, "tlsmax", "", "Tell the server the maximum TLS version to accept, one of 1.0, 1.1, 1.2 or 1.3. If empty, the highest supported version is accepted.")
+	flag.StringVar(&tlsCiphers, "tlsciphers", "", "Provide a comma separated list of cipher suites to accept for TLS 1.2 and below, such as TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. The cipher suites of TLS 1.3 can't be changed. If empty, secure defaults are used.")
+	flag.StringVar(&tlsCurvePrefs, "tlscurves", "", "Provide a comma separated list of curves to use for key exchange in order of preference, from X25519, P256, P384 and P521. If empty, secure defaults are used.")
+	flag.DurationVar(&tlsTicketRotate, "tlsticketrotate", 0, "Tell the server how often to replace the key that encrypts TLS session tickets, such as 1h. Sessions can be resumed with the previous keys for "+strconv.Itoa(TLSTicketKeys-1)+" more intervals. If 0, the TLS library rotates the key automatically.")
+	flag.StringVar(&certificatePath, "cert", "cert.pem", "Provide the server with a certificate file to load in .pem format. The file can contain the full chain, with the server certificate first. Unless -key is set, the file must also contain the private key.")
+	flag.StringVar(&keyPath, "key", "", "Provide the server with a private key file to load in .pem format, such as privkey.pem from certbot. If empty, the private key is loaded from -cert. Generated certificates write their key to this file.")
+	flag.StringVar(&keyPassFile, "keypassfile", "", "Provide a file containing the passphrase for an encrypted PKCS#8 private key.")
+	flag.StringVar(&keyPassEnv, "keypassenv", "", "Provide the name of an environment variable containing the passphrase for an encrypted PKCS#8 private key.")
 	flag.BoolVar(&certificateGen, "certgen", false, "Tell the server to automatically generate a certificate. (default false)")
 	flag.BoolVar(&certificateWrite, "certgenwrite", true, "Tell the server to write the generated certificate to the file set in -cert. If you do not write the file to -cert and generate it on launch, you will have a different certificate each time the server launches.")
+	flag.StringVar(&certificateDNSNames, "certdns", "localhost", "Provide a comma separated list of DNS names for the certificate generated with -certgen.")
+	flag.StringVar(&certificateIPs, "certip", "127.0.0.1", "Provide a comma separated list of IP addresses for the certificate generated with -certgen.")
+	flag.StringVar(&certificateKeyType, "certkey", CertKeyECDSAP521, "Tell the server what type of private key to generate for -certgen, one of "+CertKeyECDSAP256+", "+CertKeyECDSAP384+", "+CertKeyECDSAP521+", "+CertKeyEd25519+", "+CertKeyRSA2048+" or "+CertKeyRSA4096+".")
+	flag.DurationVar(&certificateValidity, "certvalidity", time.Hour*24*365*10, "Tell the server how long the certificate generated with -certgen is valid for, which must be longer than -certrenew.")
+	flag.StringVar(&certificateCAPath, "certca", "", "Provide a file for a local certificate authority in .pem format, which signs the certificate generated with -certgen instead of it being self-signed. If the file does not exist, a certificate authority is generated and written to it, so it can be given to clients to trust. If empty, the generated certificate is self-signed.")
+	flag.StringVar(&certificateCAKeyPath, "certcakey", "ca-key.pem", "Provide a file for the private key of the certificate authority set in -certca. Keep this file private.")
+	flag.StringVar(&caKeyPassFile, "certcakeypassfile", "", "Provide a file containing the passphrase for the private key of the certificate authority set in -certca, if it is an encrypted PKCS#8 private key. The passphrase set with -keypassfile or -keypassenv is not used for it.")
+	flag.StringVar(&caKeyPassEnv, "certcakeypassenv", "", "Provide the name of an environment variable containing the passphrase for the private key of the certificate authority set in -certca, if it is an encrypted PKCS#8 private key.")
+	flag.DurationVar(&certificateWarn, "certwarn", time.Hour*24*30, "Tell the server how long before a certificate, including the certificates of virtual hosts, expires to start logging warnings about its expiry.")
+	flag.DurationVar(&certificateRenew, "certrenew", time.Hour*24*30, "Tell the server how long before a certificate generated with -certgen expires to generate a new one. The new certificate is used for new connections without restarting the server.")
+	flag.BoolVar(&certificateRenewKey, "certrenewkey", true, "Tell the server to keep the private key of a generated certificate when generating a new one. The fingerprint of the new certificate still changes, so clients must trust it again unless it is signed by -certca.")
+	flag.DurationVar(&certificateReload, "certreload", 0, "Tell the server how often to check the file set in -cert for changes, such as 1m. A changed certificate is used for new connections without restarting the server. If 0, the file is not checked.")
+	flag.Var(&acmeHosts, "acme", "Provide a host name to obtain a certificate for from an ACME server such as Let's Encrypt, using TLS-ALPN-01 challenges on the server's listening address, which must be reachable on port 443 by the ACME server. Clients connecting with this host name receive the obtained certificate, other clients receive the certificate from -cert or -certgen. Using ACME accepts the terms of service of the ACME server. Can be provided multiple times.")
+	flag.StringVar(&acmeDirectoryURL, "acmedir", acme.LetsEncryptURL, "Provide the directory URL of the ACME server.")
+	flag.StringVar(&acmeCacheDir, "acmecache", "acme-cache", "Provide the directory that certificates and the account key obtained with ACME are stored in.")
+	flag.StringVar(&acmeEmail, "acmeemail", "", "Provide a contact email address for the ACME account.")
+	flag.StringVar(&acmeRootCA, "acmeca", "", "Provide a file containing root certificates in .pem format to trust when connecting to the ACME server, such as the root certificate of a local test server.")
+	flag.BoolVar(&certificateInfo, "certinfo", false, "Tell the server to print information about the certificate set in -cert, or generated with -certgen, including its SHA-256 fingerprint, and exit. (default false)")
+	flag.Var(&vhostSpecs, "vhost", "Provide a host name with its own certificate, in the form host=cert.pem or host=cert.pem,key.pem. Clients requesting this host name with SNI receive this certificate, and other clients receive the certificate from -cert. A host name such as *.example.com matches any single label. Can be provided multiple times.")
+	flag.BoolVar(&vhostIsolate, "vhostisolate", false, "Tell the server to give each host set with -vhost its own channels, so that a channel can only be joined by clients that requested the same host name. Channels are then named host/channel in logs and the admin API. Clients that did not request one of these host names share channels named /channel. (default false)")
+	flag.StringVar(&clientCAPath, "clientca", "", "Provide a file containing certificate authorities in .pem format. Clients must then connect with a certificate signed by one of them, so listeners without TLS can't be used unless -clientauth is optional. If empty, client certificates are not requested.")
+	flag.StringVar(&clientAuthMode, "clientauth", ClientAuthRequire, "Tell the server whether client certificates are required when -clientca is set, either "+ClientAuthRequire+", or "+ClientAuthOptional+" to verify a certificate only when a client sends one.")
+	flag.Var(&clientAllowRules, "clientallow", "Provide a rule in the form channel=common name, allowing clients whose certificate common name matches to join channels that match. Both can contain wildcards such as * and ?. If any rules are provided, clients can only join channels that a rule allows them to. Can be provided multiple times.")
 	flag.BoolVar(&launch, "launch", true, "Tell the server to launch. Most commonly used when generating a certificate and you don't want the server to launch.")
 	flag.IntVar(&logLevel, "loglevel", LogLevelInfo, "Tell the server what log level to use. Minimum 0, maximum "+strconv.Itoa(LogLevelMax-1)+".")
+	flag.StringVar(&logFormat, "logformat", LogFormatText, "Tell the server what log format to use, either "+LogFormatText+" or "+LogFormatJSON+".")
+	flag.StringVar(&logFile, "logfile", "", "Provide a file that the server will write its log to, in addition to the console.")
+	flag.IntVar(&logFileLevel, "logfilelevel", -1, "Tell the server what log level to use for the log file. If less than 0, the value of -loglevel is used.")
+	flag.IntVar(&logFileMaxSize, "logfilemaxsize", 10, "Tell the server the size in megabytes at which the log file is rotated. If 0, the log file is not rotated by size.")
+	flag.DurationVar(&logFileMaxAge, "logfilemaxage", 0, "Tell the server how long to write to a log file before it is rotated, such as 24h. If 0, the log file is not rotated by age.")
+	flag.IntVar(&logFileBackups, "logfilebackups", 5, "Tell the server how many rotated log files to keep. If 0, all rotated log files are kept.")
+	flag.BoolVar(&logSyslog, "logsyslog", false, "Tell the server to write its log to the local syslog daemon, in addition to the console. (default false)")
+	flag.IntVar(&logSyslogLevel, "logsysloglevel", -1, "Tell the server what log level to use for syslog. If less than 0, the value of -loglevel is used.")
+	flag.DurationVar(&logLevelTimeout, "logleveltimeout", time.Minute*15, "Tell the server how long a log level changed while the server is running lasts before it is restored. If 0, the changed log level lasts until it is restored manually.")
+	flag.DurationVar(&drainTimeout, "draintimeout", time.Hour, "Provide how long the server keeps serving connected clients after handing its listeners to a new server process on SIGHUP, before disconnecting them. If 0, the server waits for every client to disconnect.")
+	flag.StringVar(&adminAddr, "adminaddr", "", "Provide a listening address for the admin API, such as 127.0.0.1:6838. If empty, the admin API is disabled.")
+	flag.StringVar(&adminToken, "admintoken", "", "Provide a token that admin API requests must send as a bearer token in the Authorization header. Unless a token is set, the admin API must be on a loopback address.")
+	flag.Var(&interceptChannels, "interceptchannel", "Provide a channel whose protocol data will be logged regardless of the log level. Only clients in this channel are notified of the interception. Can be provided multiple times.")
+	flag.Var(&interceptClients, "interceptclient", "Provide a client ID whose protocol data will be logged regardless of the log level. Only clients in the channel of this client are notified of the interception. Can be provided multiple times.")
+	flag.BoolVar(&interceptRedact, "interceptredact", false, "Tell the server to redact sensitive fields from intercepted protocol data, keeping message types and sizes. (default false)")
+	flag.StringVar(&interceptRedactFields, "interceptredactfields", DefaultRedactFields, "Provide a comma separated list of fields to redact from intercepted protocol data. Each field is either type:field to redact it from one message type, or field to redact it from every message type. Fields are also redacted from objects nested in a message.")
+	flag.Var(&recordChannels, "recordchannel", "Provide a channel whose traffic will be recorded to a file, which can be played with the replay subcommand. Clients in this channel are notified of the recording. Can be provided multiple times.")
+	flag.StringVar(&recordDir, "recorddir", ".", "Provide the directory that recordings of channels are written to. Each recording is named by a hash of its channel and the time it started.")
+	flag.BoolVar(&recordKey, "recordkey", false, "Tell the server to store the channel key in recordings, so that the replay subcommand can join the recorded channel without -channel. Otherwise, only a hash of the channel is stored. (default false)")
 	flag.BoolVar(&sendOrigin, "sendorigin", true, "Tell the server to automatically inject an origin field when sending data to a channel. This is required for braille displays to work correctly.")
 	flag.StringVar(&motd, "motd", "", "Provide a message of the day that clients will receive upon joining a channel.")
 	flag.BoolVar(&motdAlwaysDisplay, "motdforce", false, "Tell the server to force the message of the day to always display on connected clients when they join a channel. (default false)")
+	flag.Var(&webhookURLs, "webhook", "Provide a URL that will receive channel events as JSON with an HTTP POST request. Channels are identified by a hash of their key, so that the key is not revealed to the receiver. Can be provided multiple times.")
+	flag.StringVar(&webhookSecret, "webhooksecret", "", "Provide a secret used to sign webhook requests. The HMAC-SHA256 signature of the request body is sent in the "+WebhookSignatureHeader+" header.")
+	flag.DurationVar(&pingInterval, "pinginterval", 0, "Provide how often the server sends a ping message to clients in channels, which clients ignore. Regular pings keep connections through NAT devices and proxies from expiring. If 0, no pings are sent.")
+	flag.DurationVar(&pingTimeout, "pingtimeout", 0, "Provide how long a client can send nothing before it is disconnected as a dead peer, and removed from its channel without being held for resuming its session. NVDA doesn't answer ping messages, so this must be longer than clients stay idle. If 0, silent clients are only disconnected when TCP keepalive fails.")
+	flag.DurationVar(&resumeGrace, "resumegrace", 0, "Provide how long a client that disconnected from a channel keeps its place, so that it can resume its session with the resume token it received when joining. Messages sent to the client in this time are delivered when it resumes. If 0, sessions can't be resumed.")
+	flag.StringVar(&idStrategy, "idstrategy", IDStrategySequential, "Tell the server how to assign client IDs, either "+IDStrategySequential+", or "+IDStrategyRandom+" for random IDs that don't reveal how many clients the server has served and can't be guessed.")
 	flag.Parse()
+	if len(addrs) == 0 {
+		addrs = defaultAddrs()
+	}
+	if err := checkFlags(); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		os.Exit(2)
+	}
+}
+
+// checkFlags returns an error if flags that depend on each other have values that can't be used together.
+func checkFlags() error {
+	if certificateValidity <= 0 {
+		return fmt.Errorf("%w: -certvalidity %s must be greater than 0", ErrCertValidity, certificateValidity)
+	}
+	// A certificate that expires within -certrenew of being generated would be generated again at every check.
+	if certificateValidity <= certificateRenew {
+		return fmt.Errorf("%w: -certvalidity %s must be longer than -certrenew %s", ErrCertValidity, certificateValidity, certificateRenew)
+	}
+	return nil
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// interceptTargets are the channels and client IDs whose protocol data is intercepted,
+// regardless of the log level.
+type interceptTargets struct {
+	mu       sync.RWMutex
+	channels map[string]struct{}
+	clients  map[uint64]struct{}
+}
+
+// newInterceptTargets creates intercept targets from channel names and client IDs.
+// Invalid client IDs are logged and skipped.
+func newInterceptTargets(channels, clients []string, l *Logger) *interceptTargets {
+	it := &interceptTargets{
+		channels: make(map[string]struct{}),
+		clients:  make(map[uint64]struct{}),
+	}
+	for _, ch := range channels {
+		it.channels[ch] = struct{}{}
+		l.Debugf("Protocol data will be intercepted for channel \"%s\"\n", ch)
+	}
+	for _, v := range clients {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || id == 0 {
+			l.Errorf("Invalid client ID \"%s\" to intercept, it will not be used.\n", v)
+			continue
+		}
+		it.clients[id] = struct{}{}
+		l.Debugf("Protocol data will be intercepted for client %d\n", id)
+	}
+	return it
+}
+
+func (it *interceptTargets) hasChannel(channel string) bool {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	_, ok := it.channels[channel]
+	return ok
+}
+
+func (it *interceptTargets) hasClient(id uint64) bool {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	_, ok := it.clients[id]
+	return ok
+}
+
+// has reports whether the protocol data of the client is intercepted.
+func (it *interceptTargets) has(c *Client) bool {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	if _, ok := it.channels[c.channel]; ok && c.channel != "" {
+		return true
+	}
+	_, ok := it.clients[c.id]
+	return ok && c.id != 0
+}
+
+// empty reports whether there are no intercept targets.
+func (it *interceptTargets) empty() bool {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	return len(it.channels) == 0 && len(it.clients) == 0
+}
+
+func (it *interceptTargets) setChannel(channel string, enable bool) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if enable {
+		it.channels[channel] = struct{}{}
+	} else {
+		delete(it.channels, channel)
+	}
+}
+
+func (it *interceptTargets) setClient(id uint64, enable bool) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if enable {
+		it.clients[id] = struct{}{}
+	} else {
+		delete(it.clients, id)
+	}
+}
+
+// list returns the intercepted channels and client IDs, sorted.
+func (it *interceptTargets) list() (channels []string, clients []uint64) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	channels = make([]string, 0, len(it.channels))
+	for ch := range it.channels {
+		channels = append(channels, ch)
+	}
+	clients = make([]uint64, 0, len(it.clients))
+	for id := range it.clients {
+		clients = append(clients, id)
+	}
+	sort.Strings(channels)
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+	return channels, clients
+}
+
+// channelIntercepted reports whether any protocol data in the channel is intercepted,
+// either because the channel is a target or recorded, or because one of its clients is a target.
+func (s *Server) channelIntercepted(channel string) bool {
+	if s.record.enabled(channel) {
+		return true
+	}
+	if s.intercept.empty() {
+		return false
+	}
+	if s.intercept.hasChannel(channel) {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for c := range s.channels[channel] {
+		if s.intercept.hasClient(c.id) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendInterceptNotice notifies every client in the channel except skip that information about it is being intercepted.
+func (s *Server) sendInterceptNotice(channel string, skip *Client) {
+	s.mu.RLock()
+	clients := make([]*Client, 0, len(s.channels[channel]))
+	for c := range s.channels[channel] {
+		if c != skip {
+			clients = append(clients, c)
+		}
+	}
+	s.mu.RUnlock()
+	sendInterceptNotices(clients)
+}
+
+// levelRaised notifies every client in a channel that information about it is being intercepted,
+// when the log level is raised at runtime to a level that logs channel information.
+func (s *Server) levelRaised(level LogLevelStr) {
+	if level < LogLevelDebug {
+		return
+	}
+	s.mu.RLock()
+	var clients []*Client
+	for _, ch := range s.channels {
+		for c := range ch {
+			clients = append(clients, c)
+		}
+	}
+	s.mu.RUnlock()
+	sendInterceptNotices(clients)
+}
+
+// sendInterceptNotices sends each client the notice returned by its interceptNotice method, if any.
+func sendInterceptNotices(clients []*Client) {
+	for _, c := range clients {
+		if notice := c.interceptNotice(); notice != "" {
+			c.SendMsg(Msg{
+				"type":               TypeMotd,
+				"motd":               notice,
+				TypeMotdForceDisplay: true,
+			})
+		}
+	}
+}
+
+// findClient returns the client in a channel with the given ID, or nil if there is none.
+func (s *Server) findClient(id uint64) *Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, ch := range s.channels {
+		for c := range ch {
+			if c.id == id {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// interceptChannel enables or disables protocol interception for a channel.
+func (s *Server) interceptChannel(channel string, enable bool) {
+	s.intercept.setChannel(channel, enable)
+	if enable {
+		s.l.Infof("Protocol data will be intercepted for channel \"%s\"\n", channel)
+		s.sendInterceptNotice(channel, nil)
+	} else {
+		s.l.Infof("Protocol data will no longer be intercepted for channel \"%s\"\n", channel)
+	}
+}
+
+// interceptClient enables or disables protocol interception for a client ID.
+func (s *Server) interceptClient(id uint64, enable bool) {
+	s.intercept.setClient(id, enable)
+	if !enable {
+		s.l.Infof("Protocol data will no longer be intercepted for client %d\n", id)
+		return
+	}
+	s.l.Infof("Protocol data will be intercepted for client %d\n", id)
+	if c := s.findClient(id); c != nil {
+		s.sendInterceptNotice(c.channel, nil)
+	}
+}
+
+// intercepting reports whether the protocol data of the client is logged.
+func (c *Client) intercepting() bool {
+	return c.srv.l.Level() >= LogLevelIntercept || c.srv.intercept.has(c)
+}
+
+// interceptf logs protocol data of the client if it is intercepted.
+func (c *Client) interceptf(format string, v ...any) {
+	if !c.intercepting() {
+		return
+	}
+	c.log().Capturef(format, v...)
+}
+
+// interceptData logs a line of protocol data sent to or received from the client if it is intercepted,
+// with its size and how long after the client connected it was sent or received.
+// If redaction is enabled, sensitive fields are redacted from the line first.
+func (c *Client) interceptData(direction string, line []byte) {
+	if !c.intercepting() {
+		return
+	}
+	c.log().Capturef("%s client %s, %d bytes, %s after connecting\n%s\n", direction, c.value(), len(line), c.connectedDuration(), c.srv.redact.redact(line))
+}
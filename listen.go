@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenOptions are the options that can be provided for a listening address, for each scheme.
+var listenOptions = map[string]map[string]struct{}{
+	SchemeTLS: {
+		"tlsmin":       {},
+		"tlsmax":       {},
+		"tlsciphers":   {},
+		"tlscurves":    {},
+		"proxy":        {},
+		"proxytrusted": {},
+		"fd":           {},
+	},
+	SchemeTCP: {
+		"force":        {},
+		"proxy":        {},
+		"proxytrusted": {},
+		"fd":           {},
+	},
+	SchemeWS: {
+		"force":        {},
+		"proxy":        {},
+		"proxytrusted": {},
+		"path":         {},
+		"origins":      {},
+		"fd":           {},
+	},
+	SchemeUnix: {
+		"mode":  {},
+		"group": {},
+		"fd":    {},
+	},
+	SchemeWSS: {
+		"tlsmin":       {},
+		"tlsmax":       {},
+		"tlsciphers":   {},
+		"tlscurves":    {},
+		"proxy":        {},
+		"proxytrusted": {},
+		"path":         {},
+		"origins":      {},
+		"fd":           {},
+	},
+}
+
+// listenSpec is a listening address with options, in the form scheme://address?option=value&option=value.
+// If the scheme is omitted, it is tls. For the unix scheme, the address is the path of the socket, such as unix:///run/remote.sock.
+// If the fd option is set, a socket passed by systemd is used, and the address is ignored.
+type listenSpec struct {
+	orig   string
+	scheme string
+	addr   string
+	opts   url.Values
+}
+
+// parseListenSpec parses a listening address with options.
+func parseListenSpec(s string) (listenSpec, error) {
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok {
+		scheme, rest = SchemeTLS, s
+	}
+	known, ok := listenOptions[scheme]
+	if !ok {
+		return listenSpec{}, fmt.Errorf("%w: %s: unknown scheme %s", ErrListenSpec, s, scheme)
+	}
+	addr, query, _ := strings.Cut(rest, "?")
+	opts, err := url.ParseQuery(query)
+	if err != nil {
+		return listenSpec{}, fmt.Errorf("%w: %s: %v", ErrListenSpec, s, err)
+	}
+	for name := range opts {
+		if _, ok := known[name]; !ok {
+			return listenSpec{}, fmt.Errorf("%w: %s: unknown option %s for %s listener", ErrListenSpec, s, name, scheme)
+		}
+	}
+	return listenSpec{
+		orig:   s,
+		scheme: scheme,
+		addr:   addr,
+		opts:   opts,
+	}, nil
+}
+
+// option returns the value of an option, or def if it is not set.
+func (ls listenSpec) option(name, def string) string {
+	if ls.opts.Has(name) {
+		return ls.opts.Get(name)
+	}
+	return def
+}
+
+// boolOption returns the value of an option that is true or false, or false if it is not set.
+// An option set without a value, such as ?force, is true.
+func (ls listenSpec) boolOption(name string) (bool, error) {
+	if !ls.opts.Has(name) {
+		return false, nil
+	}
+	v := ls.opts.Get(name)
+	if v == "" {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%w: option %s must be true or false", ErrListenSpec, name)
+	}
+	return b, nil
+}
+
+// tlsPolicy returns the TLS policy of the listener.
+// Options that are not set for the listener use the values of the -tls flags.
+func (ls listenSpec) tlsPolicy() (tlsPolicy, error) {
+	return parseTLSPolicy(
+		ls.option("tlsmin", tlsMinVersion),
+		ls.option("tlsmax", tlsMaxVersion),
+		ls.option("tlsciphers", tlsCiphers),
+		ls.option("tlscurves", tlsCurvePrefs),
+	)
+}
+
+// listen creates the listener for spec.
+// Anything the listener runs in the background stops when done is closed.
+func (s *Server) listen(spec listenSpec, done <-chan struct{}) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	switch spec.scheme {
+	case SchemeTCP, SchemeWS, SchemeUnix:
+		// Clients of listeners without TLS can't send a certificate, so they would join without one.
+		if s.clientAuth.requiresCert() {
+			return nil, fmt.Errorf("%w: %s does not use TLS, so it can't verify the client certificates required by -clientca", ErrClientAuth, spec.orig)
+		}
+	}
+	switch spec.scheme {
+	case SchemeTCP, SchemeWS:
+		ln, err = s.listenPlain(spec)
+	case SchemeUnix:
+		ln, err = s.listenUnix(spec)
+	default:
+		ln, err = s.listenTLS(spec, done)
+	}
+	if err == nil && s.clientAuth != nil && (spec.scheme == SchemeTCP || spec.scheme == SchemeWS || spec.scheme == SchemeUnix) {
+		s.l.Warnf("Client certificates can't be verified on listener %s, which does not use TLS.\n", ln.Addr())
+	}
+	if err != nil || (spec.scheme != SchemeWS && spec.scheme != SchemeWSS) {
+		return ln, err
+	}
+	wl, err := s.listenWebSocket(spec, ln)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return wl, nil
+}
+
+// doneListener closes done when it is closed, stopping anything run in the background for the listener.
+type doneListener struct {
+	net.Listener
+	done chan struct{}
+	once sync.Once
+}
+
+// Close implements net.Listener for doneListener.
+func (ln *doneListener) Close() error {
+	ln.once.Do(func() {
+		close(ln.done)
+	})
+	return ln.Listener.Close()
+}
+
+// listenTCP creates a TCP listener with keepalive enabled on accepted connections.
+// The socket passed by the server process being upgraded, or by systemd if the fd option of spec is set,
+// is used instead of listening on the address, and can also be a Unix domain socket.
+func (s *Server) listenTCP(spec listenSpec) (net.Listener, error) {
+	ln, err := s.socket(spec.orig, func() (net.Listener, error) {
+		if fd := spec.option("fd", ""); fd != "" {
+			return sdListenFDs().listener(fd)
+		}
+		return net.Listen("tcp", spec.addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch ln := ln.(type) {
+	case *net.TCPListener:
+		return tcpKeepAliveListener{ln}, nil
+	case *net.UnixListener:
+		return ln, nil
+	default:
+		ln.Close()
+		return nil, ErrNotTCP
+	}
+}
+
+// listenTLS creates a TLS listener, using the TLS policy of spec.
+func (s *Server) listenTLS(spec listenSpec, done <-chan struct{}) (net.Listener, error) {
+	if s.cfg == nil {
+		return nil, ErrNotTLS
+	}
+	policy, err := spec.tlsPolicy()
+	if err != nil {
+		return nil, err
+	}
+	cfg := s.cfg.Clone()
+	policy.apply(cfg)
+	if s.certs.acme != nil {
+		allowACMEChallenges(cfg)
+	}
+	for _, problem := range policy.check(s.certs.Load()) {
+		s.l.Warnf("TLS policy for %s: %s\n", spec.addr, problem)
+	}
+
+	tcpLn, err := s.listenTCP(spec)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := s.proxyWrap(spec, tcpLn)
+	if err != nil {
+		tcpLn.Close()
+		return nil, err
+	}
+	if tlsTicketRotate > 0 {
+		go rotateTicketKeys(cfg, tlsTicketRotate, done, s.l)
+	}
+	s.l.Infof("TLS policy for %s: %s\n", ln.Addr(), policy)
+	return tls.NewListener(ln, cfg), nil
+}
+
+// listenPlain creates a TCP listener without TLS, for use behind a proxy that terminates TLS.
+// Unless the force option is set, the listener must be on a loopback address,
+// so that protocol data is not sent over the network unencrypted.
+func (s *Server) listenPlain(spec listenSpec) (net.Listener, error) {
+	force, err := spec.boolOption("force")
+	if err != nil {
+		return nil, err
+	}
+	if !force && spec.option("fd", "") == "" && !isLoopbackAddr(spec.addr) {
+		return nil, fmt.Errorf("%w: %s, add ?force=1 to the address to allow it", ErrNotLoopback, spec.addr)
+	}
+	tcpLn, err := s.listenTCP(spec)
+	if err != nil {
+		return nil, err
+	}
+	// The address of a socket passed by systemd is only known once it is used.
+	if !force && !isLoopbackAddr(tcpLn.Addr().String()) {
+		tcpLn.Close()
+		return nil, fmt.Errorf("%w: %s, add ?force=1 to the address to allow it", ErrNotLoopback, tcpLn.Addr())
+	}
+	ln, err := s.proxyWrap(spec, tcpLn)
+	if err != nil {
+		tcpLn.Close()
+		return nil, err
+	}
+	s.l.Warnf("Listener %s does not use TLS. Connections to it must be encrypted by a proxy.\n", ln.Addr())
+	return ln, nil
+}
+
+// isLoopbackAddr reports whether the host of addr is localhost or a loopback IP address.
+// An empty host listens on all addresses, and is not a loopback address.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
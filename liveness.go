@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// monitorClients sends a ping message to clients in channels every interval, until the server is shut down or drained.
+// Clients ignore pings, but sending them keeps connections through NAT devices and proxies from expiring.
+// If interval is 0, no pings are sent.
+func (s *Server) monitorClients(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	s.l.Debugf("Sending ping messages to clients every %s.\n", interval)
+	for {
+		select {
+		case <-t.C:
+			s.pingClients()
+		case <-s.monitorDone:
+			return
+		}
+	}
+}
+
+// stopMonitoring stops monitorClients.
+func (s *Server) stopMonitoring() {
+	s.monitorOnce.Do(func() {
+		close(s.monitorDone)
+	})
+}
+
+// pingClients sends a ping message to every connected client in a channel.
+// Clients that have not joined a channel are still in the handshake, which has its own timeouts.
+func (s *Server) pingClients() {
+	s.mu.RLock()
+	var clients []*Client
+	for _, ch := range s.channels {
+		for c := range ch {
+			if !c.isHeld() {
+				clients = append(clients, c)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, c := range clients {
+		c.SendMsg(MsgPing)
+	}
+	if len(clients) > 0 {
+		s.l.Debugf("Sent ping to %d clients.\n", len(clients))
+	}
+}
+
+// refreshReadDeadline gives the client -pingtimeout to send more data,
+// after which reading from it fails and it is disconnected as a dead peer.
+// If -pingtimeout is 0, clients can stay silent for as long as their connection is open.
+func (c *Client) refreshReadDeadline() {
+	if pingTimeout > 0 {
+		_ = c.conn.SetReadDeadline(time.Now().Add(pingTimeout))
+	}
+}
+
+// isDeadPeer reports whether a read or write error means the peer stopped responding,
+// because it sent nothing for -pingtimeout, a write did not complete within its deadline,
+// or TCP keepalive failed.
+func isDeadPeer(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT)
+}
+
+// markDead records that the client stopped responding, so that it is removed from its channel when it's closed,
+// instead of being held for resuming its session.
+func (c *Client) markDead() {
+	c.mu.Lock()
+	c.dead = true
+	c.mu.Unlock()
+}
+
+func (c *Client) isDead() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dead
+}
+
+// lastReadTime returns when data was last received from the client, or when it connected if it sent nothing.
+func (c *Client) lastReadTime() time.Time {
+	return time.Unix(0, c.lastRead.Load())
+}
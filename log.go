@@ -1,10 +1,13 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Constants for log levels, starting at 0.
@@ -19,6 +22,12 @@ const (
 	LogLevelMax // maximum log level should always be LogLevelMax-1
 )
 
+// Log formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
 // LogLevelStr is an int with a Stringer interface.
 type LogLevelStr int
 
@@ -42,85 +51,381 @@ func (l LogLevelStr) String() string {
 	}
 }
 
+// prefix returns the prefix used for the log level in the text log format.
+func (l LogLevelStr) prefix() string {
+	switch l {
+	case LogLevelInfo:
+		return "INFO:  "
+	case LogLevelWarn:
+		return "WARN:  "
+	case LogLevelError:
+		return "ERROR: "
+	case LogLevelDebug:
+		return "DEBUG: "
+	case LogLevelIntercept:
+		return "INTERCEPT: "
+	default:
+		return ""
+	}
+}
+
 var logger *Logger
 
+// LogFields are structured fields attached to a log record.
+// They are only written when using the JSON log format.
+type LogFields struct {
+	ClientID       uint64 `json:"client_id,omitempty"`
+	RemoteAddr     string `json:"remote_addr,omitempty"`
+	Channel        string `json:"channel,omitempty"`
+	ConnectionType string `json:"connection_type,omitempty"`
+	CertSubject    string `json:"cert_subject,omitempty"`
+	Event          string `json:"event,omitempty"`
+}
+
+// logRecord is a single record written with the JSON log format.
+type logRecord struct {
+	Level   string `json:"level"`
+	Time    string `json:"time"`
+	Message string `json:"message"`
+	LogFields
+}
+
 // Logger defines a logger that is used with the various log levels.
+// Records are written to every output with a level at least as verbose as the record.
+//
+// The level of every output can be overridden while the server is running with SetLevel.
 type Logger struct {
-	level  LogLevelStr
-	logger *log.Logger
-	mu     sync.Mutex
+	level    atomic.Int32 // most verbose level of any output, read without locking
+	format   string
+	outputs  []logOutput
+	override LogLevelStr // level of every output, if overridden
+	expires  time.Time   // when the override is removed, zero if never
+	revert   *time.Timer
+	gen      int
+	onRaise  func(level LogLevelStr)
+	mu       sync.Mutex
+}
+
+// logOutput is a log sink with its own log level.
+// If bare is true, records are written without the time and level prefix in the text format,
+// for sinks that record those themselves.
+type logOutput struct {
+	level LogLevelStr
+	sink  logSink
+	bare  bool
 }
 
-// NewLogger creates a logger with the level set,
+// NewLogger creates a logger with the level and format set,
 // providing various verbocity levels for logging.
+// Records at or below level are written to the console.
 //
 // If level is less than the minimum log level,
 // it wil be set to the minimum log level.
 // If level is greater than the maximum log level,
 // it will be set to the maximum log level.
-func NewLogger(level int) *Logger {
+// If format is not a known log format, the text format is used.
+func NewLogger(level int, format string) *Logger {
 	msgpost := "Logger created."
-	if level < LogLevelNone {
-		msgpost += " Initial value less than valid range at " + strconv.Itoa(level) + "."
-		level = LogLevelNone
-	} else if level > LogLevelMax-1 {
-		msgpost += " Initial value greater than valid range at " + strconv.Itoa(level) + "."
-		level = LogLevelMax - 1
+	ll, msg := clampLogLevel(level)
+	msgpost += msg + " Using level: " + ll.String() + "."
+
+	if format != LogFormatText && format != LogFormatJSON {
+		msgpost += " Unknown log format \"" + format + "\"."
+		format = LogFormatText
 	}
-	ll := LogLevelStr(level)
-	msgpost += " Using level: " + ll.String() + "."
+	msgpost += " Using format: " + format + "."
 
 	l := &Logger{
-		level:  ll,
-		logger: log.New(os.Stdout, "", log.LstdFlags),
+		format:   format,
+		override: -1,
 	}
+	l.addOutput(ll, consoleSink{}, false)
 
 	l.Debugf("%s\n", msgpost)
 
 	return l
 }
 
-func (l *Logger) Infof(format string, v ...any) {
-	if l.level >= LogLevelInfo {
-		l.mu.Lock()
-		defer l.mu.Unlock()
-		l.logger.SetPrefix("INFO:  ")
-		l.logger.Printf(format, v...)
+// clampLogLevel returns level within the valid log level range,
+// and a message describing the change if one was made.
+func clampLogLevel(level int) (LogLevelStr, string) {
+	if level < LogLevelNone {
+		return LogLevelNone, " Initial value less than valid range at " + strconv.Itoa(level) + "."
+	} else if level > LogLevelMax-1 {
+		return LogLevelMax - 1, " Initial value greater than valid range at " + strconv.Itoa(level) + "."
 	}
+	return LogLevelStr(level), ""
 }
 
-func (l *Logger) Warnf(format string, v ...any) {
-	if l.level >= LogLevelWarn {
-		l.mu.Lock()
-		defer l.mu.Unlock()
-		l.logger.SetPrefix("WARN:  ")
-		l.logger.Printf(format, v...)
+// addOutput adds a sink that receives records at or below level.
+func (l *Logger) addOutput(level LogLevelStr, sink logSink, bare bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.outputs = append(l.outputs, logOutput{
+		level: level,
+		sink:  sink,
+		bare:  bare,
+	})
+	l.updateLevel()
+}
+
+// updateLevel stores the most verbose level of any output.
+// l.mu must be held.
+func (l *Logger) updateLevel() {
+	level := l.override
+	if level < 0 {
+		for _, o := range l.outputs {
+			if o.level > level {
+				level = o.level
+			}
+		}
 	}
+	l.level.Store(int32(level))
 }
 
-func (l *Logger) Errorf(format string, v ...any) {
-	if l.level >= LogLevelError {
-		l.mu.Lock()
-		defer l.mu.Unlock()
-		l.logger.SetPrefix("ERROR: ")
-		l.logger.Printf(format, v...)
+// Level returns the most verbose level that any log output will write.
+// It is safe to call from multiple goroutines.
+func (l *Logger) Level() LogLevelStr {
+	return LogLevelStr(l.level.Load())
+}
+
+// SetLevel overrides the level of every log output, returning the level used after clamping.
+// If timeout is greater than 0, the override is removed after timeout has elapsed.
+func (l *Logger) SetLevel(level int, timeout time.Duration) LogLevelStr {
+	ll, _ := clampLogLevel(level)
+	l.mu.Lock()
+	raised := l.onRaise
+	if ll <= l.Level() {
+		raised = nil
+	}
+	l.stopRevert()
+	l.override = ll
+	if timeout > 0 {
+		gen := l.gen
+		l.expires = time.Now().Add(timeout)
+		l.revert = time.AfterFunc(timeout, func() {
+			l.mu.Lock()
+			if l.gen != gen {
+				// SetLevel or ResetLevel was called after this timer was started.
+				l.mu.Unlock()
+				return
+			}
+			// The override is removed in the same critical section as the check, so that a SetLevel call can't be lost in between.
+			l.resetLevel()
+			l.mu.Unlock()
+			l.Infof("Log level override expired, log levels restored.\n")
+		})
+	}
+	l.updateLevel()
+	l.mu.Unlock()
+
+	if timeout > 0 {
+		l.Infof("Log level set to %s for %s.\n", ll, timeout)
+	} else {
+		l.Infof("Log level set to %s.\n", ll)
+	}
+	if raised != nil {
+		raised(ll)
 	}
+	return ll
 }
 
-func (l *Logger) Debugf(format string, v ...any) {
-	if l.level >= LogLevelDebug {
-		l.mu.Lock()
-		defer l.mu.Unlock()
-		l.logger.SetPrefix("DEBUG: ")
-		l.logger.Printf(format, v...)
+// OnRaise sets a function that is called with the new level whenever SetLevel makes the logger more verbose.
+func (l *Logger) OnRaise(fn func(level LogLevelStr)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onRaise = fn
+}
+
+// ResetLevel removes a level override set with SetLevel, restoring the level of each log output.
+func (l *Logger) ResetLevel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.resetLevel()
+}
+
+// resetLevel removes a level override.
+// l.mu must be held.
+func (l *Logger) resetLevel() {
+	l.stopRevert()
+	l.override = -1
+	l.updateLevel()
+}
+
+// LevelOverride returns the level set with SetLevel and when it will be removed.
+// If no override is set, ok is false.
+// If the override will not be removed automatically, expires is the zero time.
+func (l *Logger) LevelOverride() (level LogLevelStr, expires time.Time, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.override, l.expires, l.override >= 0
+}
+
+// stopRevert stops a pending override removal.
+// l.mu must be held.
+func (l *Logger) stopRevert() {
+	l.gen++
+	l.expires = time.Time{}
+	if l.revert != nil {
+		l.revert.Stop()
+		l.revert = nil
+	}
+}
+
+// Reopen reopens every log sink, such as log files moved by an external log rotation tool.
+func (l *Logger) Reopen() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, o := range l.outputs {
+		if err := o.sink.Reopen(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to reopen log output: %v\n", err)
+		}
 	}
 }
 
+// With returns a LogEntry that will write the given fields with each record.
+func (l *Logger) With(f LogFields) LogEntry {
+	return LogEntry{l: l, f: f}
+}
+
+func (l *Logger) Infof(format string, v ...any) {
+	l.logf(LogLevelInfo, nil, false, format, v...)
+}
+
+func (l *Logger) Warnf(format string, v ...any) {
+	l.logf(LogLevelWarn, nil, false, format, v...)
+}
+
+func (l *Logger) Errorf(format string, v ...any) {
+	l.logf(LogLevelError, nil, false, format, v...)
+}
+
+func (l *Logger) Debugf(format string, v ...any) {
+	l.logf(LogLevelDebug, nil, false, format, v...)
+}
+
 func (l *Logger) Interceptf(format string, v ...any) {
-	if l.level >= LogLevelIntercept {
-		l.mu.Lock()
-		defer l.mu.Unlock()
-		l.logger.SetPrefix("INTERCEPT: ")
-		l.logger.Printf(format, v...)
+	l.logf(LogLevelIntercept, nil, false, format, v...)
+}
+
+// logf writes a record to the log outputs with a level of at least level.
+// If force is true, the record is written to every log output that is not disabled, regardless of its level.
+func (l *Logger) logf(level LogLevelStr, f *LogFields, force bool, format string, v ...any) {
+	if !force && l.Level() < level {
+		return
+	}
+	now := time.Now()
+	msg := fmt.Sprintf(format, v...)
+
+	var line, bare []byte
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, o := range l.outputs {
+		if l.override >= 0 {
+			o.level = l.override
+		}
+		if o.level < level && (!force || o.level == LogLevelNone) {
+			continue
+		}
+		var b []byte
+		if o.bare {
+			if bare == nil {
+				bare = l.encode(level, now, msg, f, true)
+			}
+			b = bare
+		} else {
+			if line == nil {
+				line = l.encode(level, now, msg, f, false)
+			}
+			b = line
+		}
+		if err := o.sink.WriteLog(level, b); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write log record: %v\n", err)
+		}
+	}
+}
+
+// encode formats a single record with the log format of the logger.
+func (l *Logger) encode(level LogLevelStr, t time.Time, msg string, f *LogFields, bare bool) []byte {
+	if l.format == LogFormatJSON {
+		return l.formatJSON(level, t, msg, f)
+	}
+	if bare {
+		return []byte(trimNewline(msg))
+	}
+	return l.formatText(level, t, msg)
+}
+
+func (l *Logger) formatText(level LogLevelStr, t time.Time, msg string) []byte {
+	line := make([]byte, 0, len(msg)+40)
+	line = append(line, level.prefix()...)
+	line = t.AppendFormat(line, "2006/01/02 15:04:05 ")
+	line = append(line, msg...)
+	if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+		line = append(line, '\n')
+	}
+	return line
+}
+
+func (l *Logger) formatJSON(level LogLevelStr, t time.Time, msg string, f *LogFields) []byte {
+	rec := logRecord{
+		Level:   level.String(),
+		Time:    t.UTC().Format(time.RFC3339Nano),
+		Message: trimNewline(msg),
+	}
+	if f != nil {
+		rec.LogFields = *f
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		// Should never happen, every field is a string or number.
+		return l.formatText(level, t, msg)
+	}
+	return append(line, '\n')
+}
+
+// LogEntry writes log records with structured fields attached.
+type LogEntry struct {
+	l *Logger
+	f LogFields
+}
+
+// Event returns a copy of the LogEntry with the event field set.
+func (e LogEntry) Event(name string) LogEntry {
+	e.f.Event = name
+	return e
+}
+
+func (e LogEntry) Infof(format string, v ...any) {
+	e.l.logf(LogLevelInfo, &e.f, false, format, v...)
+}
+
+func (e LogEntry) Warnf(format string, v ...any) {
+	e.l.logf(LogLevelWarn, &e.f, false, format, v...)
+}
+
+func (e LogEntry) Errorf(format string, v ...any) {
+	e.l.logf(LogLevelError, &e.f, false, format, v...)
+}
+
+func (e LogEntry) Debugf(format string, v ...any) {
+	e.l.logf(LogLevelDebug, &e.f, false, format, v...)
+}
+
+func (e LogEntry) Interceptf(format string, v ...any) {
+	e.l.logf(LogLevelIntercept, &e.f, false, format, v...)
+}
+
+// Capturef writes an intercept record to every log output that is not disabled, regardless of its level.
+// It is used for intercepting the protocol data of individual channels and clients.
+func (e LogEntry) Capturef(format string, v ...any) {
+	e.l.logf(LogLevelIntercept, &e.f, true, format, v...)
+}
+
+func trimNewline(s string) string {
+	for len(s) > 0 && (s[len(s)-1] == '\n' || s[len(s)-1] == '\r') {
+		s = s[:len(s)-1]
 	}
+	return s
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// logSink is a destination for formatted log records.
+// Writes are serialized by the Logger.
+type logSink interface {
+	WriteLog(level LogLevelStr, line []byte) error
+	Reopen() error
+}
+
+// consoleSink writes log records to standard output.
+type consoleSink struct{}
+
+func (consoleSink) WriteLog(_ LogLevelStr, line []byte) error {
+	_, err := os.Stdout.Write(line)
+	return err
+}
+
+func (consoleSink) Reopen() error {
+	return nil
+}
+
+// fileSink writes log records to a file, rotating it when it grows larger than maxSize
+// or was opened longer ago than maxAge.
+// At most backups rotated files are kept, the oldest are removed first.
+type fileSink struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	backups int
+	f       *os.File
+	size    int64
+	opened  time.Time
+}
+
+func newFileSink(path string, maxSize int64, maxAge time.Duration, backups int) (*fileSink, error) {
+	fs := &fileSink{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		backups: backups,
+	}
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *fileSink) open() error {
+	f, err := os.OpenFile(fs.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("unable to open the log file %s\n%w", fs.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to read information about the log file %s\n%w", fs.path, err)
+	}
+	fs.f = f
+	fs.size = info.Size()
+	fs.opened = time.Now()
+	return nil
+}
+
+func (fs *fileSink) WriteLog(_ LogLevelStr, line []byte) error {
+	if fs.needsRotate(int64(len(line))) {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+	if fs.f == nil {
+		if err := fs.open(); err != nil {
+			return err
+		}
+	}
+	n, err := fs.f.Write(line)
+	fs.size += int64(n)
+	return err
+}
+
+// Reopen closes and reopens the log file, for use with external log rotation.
+func (fs *fileSink) Reopen() error {
+	if fs.f != nil {
+		fs.f.Close()
+		fs.f = nil
+	}
+	return fs.open()
+}
+
+func (fs *fileSink) needsRotate(n int64) bool {
+	if fs.f == nil {
+		return false
+	}
+	if fs.maxSize > 0 && fs.size > 0 && fs.size+n > fs.maxSize {
+		return true
+	}
+	return fs.maxAge > 0 && time.Since(fs.opened) > fs.maxAge
+}
+
+// rotate renames the current log file with a timestamp suffix, opens a new one,
+// and removes rotated files beyond the backup count.
+func (fs *fileSink) rotate() error {
+	fs.f.Close()
+	fs.f = nil
+	rotated := fs.path + "." + time.Now().Format(LogFileTimeFormat)
+	if err := os.Rename(fs.path, rotated); err != nil {
+		return fmt.Errorf("unable to rotate the log file %s\n%w", fs.path, err)
+	}
+	if err := fs.open(); err != nil {
+		return err
+	}
+	fs.prune()
+	return nil
+}
+
+func (fs *fileSink) prune() {
+	if fs.backups <= 0 {
+		return
+	}
+	candidates, err := filepath.Glob(fs.path + ".*")
+	if err != nil {
+		return
+	}
+	// Only files named by rotate are removed, not other files that share the name of the log file, such as server.log.bak.
+	var matches []string
+	for _, m := range candidates {
+		if _, err := time.Parse(LogFileTimeFormat, strings.TrimPrefix(m, fs.path+".")); err == nil {
+			matches = append(matches, m)
+		}
+	}
+	if len(matches) <= fs.backups {
+		return
+	}
+	// The timestamp suffix sorts in the order the files were rotated.
+	sort.Strings(matches)
+	for _, m := range matches[:len(matches)-fs.backups] {
+		_ = os.Remove(m)
+	}
+}
+
+// logSinksInit adds the log sinks configured by flags to l.
+func logSinksInit(l *Logger) error {
+	if logFile != "" {
+		level := logFileLevel
+		if level < 0 {
+			level = logLevel
+		}
+		ll, _ := clampLogLevel(level)
+		fs, err := newFileSink(logFile, int64(logFileMaxSize)*1024*1024, logFileMaxAge, logFileBackups)
+		if err != nil {
+			l.Errorf("Unable to log to file: %v\n", err)
+			return err
+		}
+		l.addOutput(ll, fs, false)
+		l.Debugf("Logging to file %s with level %s.\n", logFile, ll)
+	}
+
+	if logSyslog {
+		level := logSyslogLevel
+		if level < 0 {
+			level = logLevel
+		}
+		ll, _ := clampLogLevel(level)
+		ss, err := newSyslogSink()
+		if err != nil {
+			l.Errorf("Unable to log to syslog: %v\n", err)
+			return err
+		}
+		l.addOutput(ll, ss, true)
+		l.Debugf("Logging to syslog with level %s.\n", ll)
+	}
+	return nil
+}
@@ -1,28 +1,152 @@
 package main
 
 import (
+	"crypto/x509"
+	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
+	}
+
 	FlagsInit()
 
-	logger = NewLogger(logLevel)
+	logger = NewLogger(logLevel, logFormat)
+	if err := logSinksInit(logger); err != nil {
+		os.Exit(1)
+	}
+	handleSignals()
 
 	certificate, certerr := loadCert()
 	if certerr != nil {
 		os.Exit(1)
 	}
 
+	if certificateInfo {
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			logger.Errorf("Unable to parse certificate: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(newCertInfo(leaf))
+		os.Exit(0)
+	}
+
 	if !launch {
 		logger.Warnf("Launch set to false. This program will successfully exit.\n")
 		os.Exit(0)
 	}
 
-	server := NewServer(certificate, logger)
+	acmeManager, err := newACMEManager(logger)
+	if err != nil {
+		logger.Errorf("Unable to set up ACME: %v\n", err)
+		os.Exit(1)
+	}
+
+	certs := newCertStore(certificate, acmeManager, logger)
+	go certs.monitor(logger, certificateWarn, certificateRenew, certificateGen, certificateRenewKey)
+	if !certificateGen && certificateReload > 0 {
+		go certs.watch(logger, "", certificatePath, keyPath, certificateReload)
+	}
+	if err := loadVhosts(certs, logger, certificateReload); err != nil {
+		logger.Errorf("Unable to load virtual hosts: %v\n", err)
+		os.Exit(1)
+	}
 
-	err := server.Start(addr)
+	server, err := NewServer(certs, logger)
 	if err != nil {
+		logger.Errorf("Unable to create server: %v\n", err)
 		os.Exit(1)
 	}
+
+	// The admin API is served like the server, but failing to start it doesn't stop the server.
+	if adminAddr != "" {
+		a := newAdmin(server, adminToken)
+		if ln, err := a.Listen(adminAddr); err == nil {
+			go func() {
+				_ = a.Serve(ln)
+			}()
+		}
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, shutdownSignals...)
+	upgrade := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgrade, upgradeSignals...)
+	}
+
+	// Every listener is created before any is served, so the server is only reported as ready once it accepts connections on all of them.
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, a := range addrs {
+		ln, err := server.Listen(a)
+		if err != nil {
+			os.Exit(1)
+		}
+		listeners = append(listeners, ln)
+	}
+	sdListenFDs().closeUnused(logger)
+	upgradeListenFDs().closeUnused(logger)
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			if err := server.Serve(ln); err != nil {
+				os.Exit(1)
+			}
+		}(ln)
+	}
+	done := make(chan struct{})
+	go server.notifySystemd(done)
+	go server.monitorClients(pingInterval)
+	if err := upgradeReady(); err != nil {
+		logger.Errorf("Unable to notify the previous server process: %v\n", err)
+	}
+
+	for {
+		select {
+		case sig := <-stop:
+			logger.Infof("Received %s, shutting down.\n", sig)
+			close(done)
+			if err := sdNotify("STOPPING=1"); err != nil {
+				logger.Errorf("Unable to notify systemd: %v\n", err)
+			}
+			server.Shutdown()
+			return
+		case sig := <-upgrade:
+			logger.Infof("Received %s, upgrading to a new server process.\n", sig)
+			if err := server.Upgrade(); err != nil {
+				logger.Errorf("Unable to upgrade: %v\n", err)
+				continue
+			}
+			close(done)
+			drain(server, stop)
+			return
+		}
+	}
+}
+
+// drain keeps serving the clients connected to server after it was upgraded, until they disconnect,
+// -draintimeout passes, or the process is asked to stop.
+func drain(server *Server, stop <-chan os.Signal) {
+	drained := server.Drain()
+	var timeout <-chan time.Time
+	if drainTimeout > 0 {
+		timeout = time.After(drainTimeout)
+		logger.Infof("Stopped accepting connections, serving connected clients for up to %s.\n", drainTimeout)
+	} else {
+		logger.Infof("Stopped accepting connections, serving connected clients until they disconnect.\n")
+	}
+	select {
+	case <-drained:
+		logger.Infof("All clients disconnected, exiting.\n")
+	case <-timeout:
+		logger.Infof("Drain timeout passed, disconnecting remaining clients.\n")
+	case sig := <-stop:
+		logger.Infof("Received %s, disconnecting remaining clients.\n", sig)
+	}
+	server.Shutdown()
 }
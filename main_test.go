@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain sets every flag to its default value before running the tests, which change the flags they depend on.
+func TestMain(m *testing.M) {
+	FlagsInit()
+	os.Exit(m.Run())
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// clientAllowRule allows clients with a certificate common name matching cn to join channels matching channel.
+// Both are patterns in the syntax of path.Match.
+type clientAllowRule struct {
+	channel string
+	cn      string
+}
+
+// clientAuth is the client certificate policy of the server.
+type clientAuth struct {
+	rules    []clientAllowRule
+	required bool
+}
+
+// newClientAuth configures cfg to verify client certificates against the certificate authorities in -clientca.
+// If -clientca is empty, client certificates are not requested, and nil is returned.
+func newClientAuth(cfg *tls.Config, l *Logger) (*clientAuth, error) {
+	if clientCAPath == "" {
+		return nil, nil
+	}
+	pemData, err := os.ReadFile(clientCAPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("%w: no certificates found in %s", ErrCertNotValid, clientCAPath)
+	}
+	switch clientAuthMode {
+	case ClientAuthRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrClientAuth, clientAuthMode)
+	}
+	cfg.ClientCAs = pool
+
+	ca := &clientAuth{
+		required: clientAuthMode == ClientAuthRequire,
+	}
+	for _, spec := range clientAllowRules {
+		channel, cn, ok := strings.Cut(spec, "=")
+		if !ok || channel == "" || cn == "" {
+			return nil, fmt.Errorf("%w: \"%s\", expected channel=common name", ErrClientAuth, spec)
+		}
+		// Check the patterns now, as path.Match only reports a bad pattern when it is used.
+		if _, err := path.Match(channel, ""); err != nil {
+			return nil, fmt.Errorf("%w: \"%s\": %v", ErrClientAuth, spec, err)
+		}
+		if _, err := path.Match(cn, ""); err != nil {
+			return nil, fmt.Errorf("%w: \"%s\": %v", ErrClientAuth, spec, err)
+		}
+		ca.rules = append(ca.rules, clientAllowRule{channel: channel, cn: cn})
+	}
+	l.Debugf("Client certificates are verified with %s in %s mode, with %d channel rules.\n", clientCAPath, clientAuthMode, len(ca.rules))
+	return ca, nil
+}
+
+// requiresCert reports whether every client must authenticate with a certificate.
+func (ca *clientAuth) requiresCert() bool {
+	return ca != nil && ca.required
+}
+
+// allowed reports whether the client may join the channel.
+// If certificates are required, a client without one may not join any channel.
+// If no rules are set, every other client may join any channel.
+// Otherwise, the client must have a certificate, and a rule must match its common name and the channel.
+func (ca *clientAuth) allowed(c *Client, channel string) bool {
+	if ca == nil {
+		return true
+	}
+	if c.cert == nil {
+		return !ca.required && len(ca.rules) == 0
+	}
+	if len(ca.rules) == 0 {
+		return true
+	}
+	for _, r := range ca.rules {
+		chOK, _ := path.Match(r.channel, channel)
+		cnOK, _ := path.Match(r.cn, c.cert.Subject.CommonName)
+		if chOK && cnOK {
+			return true
+		}
+	}
+	return false
+}
+
+// certSubject returns the subject of the client certificate, or an empty string if the client did not send one.
+func (c *Client) certSubject() string {
+	if c.cert == nil {
+		return ""
+	}
+	return c.cert.Subject.String()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The keys in testdata/pkcs8 are key.pem encrypted by OpenSSL with the passphrase "test passphrase", using:
+//
+//	openssl pkcs8 -topk8 -in key.pem -v2 <cipher> -v2prf <prf> -passout "pass:test passphrase"
+//
+// with each cipher of aes-128-cbc, aes-256-cbc and des3, and each PRF of hmacWithSHA1 and hmacWithSHA256.
+const testKeyPassphrase = "test passphrase"
+
+var testEncryptedKeys = []string{
+	"aes128-sha1.pem",
+	"aes128-sha256.pem",
+	"aes256-sha1.pem",
+	"aes256-sha256.pem",
+	"des3-sha1.pem",
+	"des3-sha256.pem",
+}
+
+// readTestPEM returns the DER bytes of the first PEM block in a file in testdata/pkcs8.
+func readTestPEM(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "pkcs8", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("no PEM block in %s", name)
+	}
+	return block.Bytes
+}
+
+func TestDecryptPKCS8(t *testing.T) {
+	want, err := x509.ParsePKCS8PrivateKey(readTestPEM(t, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range testEncryptedKeys {
+		t.Run(name, func(t *testing.T) {
+			der, err := decryptPKCS8(readTestPEM(t, name), []byte(testKeyPassphrase))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := x509.ParsePKCS8PrivateKey(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Error("decrypted key does not match the unencrypted key")
+			}
+		})
+	}
+}
+
+func TestDecryptPKCS8WrongPassphrase(t *testing.T) {
+	for _, name := range testEncryptedKeys {
+		t.Run(name, func(t *testing.T) {
+			_, err := decryptPKCS8(readTestPEM(t, name), []byte("wrong passphrase"))
+			if !errors.Is(err, ErrKeyPassphrase) {
+				t.Errorf("decryptPKCS8 with the wrong passphrase returned %v, want %v", err, ErrKeyPassphrase)
+			}
+		})
+	}
+}
+
+func TestDecryptPKCS8Unencrypted(t *testing.T) {
+	_, err := decryptPKCS8(readTestPEM(t, "key.pem"), []byte(testKeyPassphrase))
+	if !errors.Is(err, ErrKeyEncryption) {
+		t.Errorf("decryptPKCS8 of an unencrypted key returned %v, want %v", err, ErrKeyEncryption)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxySignature starts a PROXY protocol version 2 header.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener accepts connections that start with a PROXY protocol header from trusted proxies,
+// such as HAProxy, which provides the address of the client that connected to the proxy.
+// Connections from other addresses are accepted unchanged.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// Accept implements net.Listener for proxyListener.
+// The PROXY protocol header is read when the connection is first used, so a slow connection does not block Accept.
+func (ln proxyListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !ln.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn}, nil
+}
+
+func (ln proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range ln.trusted {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a comma separated list of IP addresses and CIDR ranges.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range splitList(s) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("%w: %s is not an IP address or CIDR range", ErrListenSpec, item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s is not an IP address or CIDR range", ErrListenSpec, item)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// proxyConn is a connection from a trusted proxy, starting with a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+// Read implements net.Conn for proxyConn, reading the PROXY protocol header first if it has not been read.
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr implements net.Conn for proxyConn, returning the address of the client that connected to the proxy.
+// If the PROXY protocol header could not be read, or does not contain an address, the address of the proxy is returned.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+func (c *proxyConn) readHeader() {
+	c.r = bufio.NewReader(c.Conn)
+	_ = c.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+	defer func() {
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	}()
+
+	start, err := c.r.Peek(len(proxySignature))
+	if err != nil {
+		c.err = fmt.Errorf("%w: %v", ErrProxyHeader, err)
+		return
+	}
+	if bytes.Equal(start, proxySignature) {
+		c.remote, c.err = readProxyV2(c.r)
+	} else if bytes.HasPrefix(start, []byte("PROXY ")) {
+		c.remote, c.err = readProxyV1(c.r)
+	} else {
+		c.err = fmt.Errorf("%w: missing from %s", ErrProxyHeader, c.Conn.RemoteAddr())
+	}
+}
+
+// readProxyV1 reads a PROXY protocol version 1 header, such as PROXY TCP4 192.0.2.1 198.51.100.1 56324 443.
+// For PROXY UNKNOWN, a nil address is returned.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < ProxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrProxyHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: version 1 header is too long", ErrProxyHeader)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: invalid version 1 header", ErrProxyHeader)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: invalid version 1 source address", ErrProxyHeader)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a PROXY protocol version 2 header.
+// For the LOCAL command, or addresses that are not TCP over IPv4 or IPv6, a nil address is returned.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, len(proxySignature)+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProxyHeader, err)
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProxyHeader, err)
+	}
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrProxyHeader, verCmd>>4)
+	}
+	switch verCmd & 0xF {
+	case 0: // LOCAL, such as health checks from the proxy itself.
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrProxyHeader, verCmd&0xF)
+	}
+	switch fam {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: version 2 address is too short", ErrProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: version 2 address is too short", ErrProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// proxyWrap wraps ln in a proxyListener if the proxy option of spec is set.
+func (s *Server) proxyWrap(spec listenSpec, ln net.Listener) (net.Listener, error) {
+	enabled, err := spec.boolOption("proxy")
+	if err != nil || !enabled {
+		return ln, err
+	}
+	trusted, err := parseTrustedProxies(spec.option("proxytrusted", proxyTrusted))
+	if err != nil {
+		return nil, err
+	}
+	s.l.Infof("Listener %s accepts the PROXY protocol from %s\n", ln.Addr(), spec.option("proxytrusted", proxyTrusted))
+	return proxyListener{Listener: ln, trusted: trusted}, nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A recording file starts with RecordMagic, the RecordVersion byte,
+// the recording start time in Unix nanoseconds as a varint,
+// the hash of the channel, and the channel name, which is empty unless -recordkey is set.
+// The hash and name are each a uvarint length followed by their bytes.
+//
+// Each record that follows contains, in order:
+// the time since the previous record (or the start) in microseconds as a uvarint,
+// a direction byte describing the connection type of the sender,
+// the sender client ID as a uvarint,
+// and the line as a uvarint length followed by its bytes.
+const (
+	RecordMagic     = "NVRR"
+	RecordVersion   = 1
+	RecordExtension = ".nvrr"
+	RecordMaxLine   = ReadBufSize * 16
+	RecordQueueSize = 4096
+)
+
+// Record directions, describing the connection type of the client that sent the line.
+const (
+	RecordFromController byte = iota
+	RecordFromControlled
+	RecordFromOther
+)
+
+// recordDirection returns the record direction for a connection type.
+func recordDirection(connectionType string) byte {
+	switch connectionType {
+	case TypeController:
+		return RecordFromController
+	case TypeControlled:
+		return RecordFromControlled
+	default:
+		return RecordFromOther
+	}
+}
+
+// recorder writes the traffic of a channel to a recording file.
+// Records are queued by Record and written by a goroutine with a buffered writer,
+// so that a slow disk does not delay the channel.
+type recorder struct {
+	mu      sync.Mutex
+	rs      *recordings
+	channel string
+	hash    string
+	path    string
+	start   time.Time
+	last    time.Time
+	queue   chan []byte
+	closed  bool
+	dropped int
+}
+
+// newRecorder starts recording the channel to a new file in the directory of the recordings.
+// The file is named by a hash of the channel and the time, so that the channel key is not revealed by the file name.
+func (rs *recordings) newRecorder(channel string) *recorder {
+	now := time.Now()
+	hash := channelHash(channel)
+	r := &recorder{
+		rs:      rs,
+		channel: channel,
+		hash:    hash,
+		path:    filepath.Join(rs.dir, hash+"-"+now.Format(LogFileTimeFormat)+RecordExtension),
+		start:   now,
+		last:    now,
+		queue:   make(chan []byte, RecordQueueSize),
+	}
+	rs.writers.Add(1)
+	go r.run()
+	return r
+}
+
+// run creates the recording file and writes the queued records to it until the recorder is closed.
+// The channel is logged by its hash, as the recording file is named.
+func (r *recorder) run() {
+	defer r.rs.writers.Done()
+	l := r.rs.l
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		l.Errorf("Unable to record channel %s, recording stopped: unable to create the recording file %s\n%v\n", r.hash, r.path, err)
+		r.rs.stop(r)
+		for range r.queue {
+		}
+		return
+	}
+	l.Infof("Recording channel %s to %s\n", r.hash, r.path)
+
+	w := bufio.NewWriter(f)
+	hdr := append([]byte(RecordMagic), RecordVersion)
+	hdr = binary.AppendVarint(hdr, r.start.UnixNano())
+	hdr = binary.AppendUvarint(hdr, uint64(len(r.hash)))
+	hdr = append(hdr, r.hash...)
+	var name string
+	if r.rs.storeKey {
+		name = r.channel
+	}
+	hdr = binary.AppendUvarint(hdr, uint64(len(name)))
+	hdr = append(hdr, name...)
+	_, err = w.Write(hdr)
+	if err != nil {
+		l.Errorf("Unable to write recording of channel %s, recording stopped: %v\n", r.hash, err)
+		r.rs.stop(r)
+	}
+	for rec := range r.queue {
+		if err != nil {
+			continue
+		}
+		if _, err = w.Write(rec); err == nil && len(r.queue) == 0 {
+			// Records are flushed whenever the queue is empty, so that the file is complete if the server stops unexpectedly.
+			err = w.Flush()
+		}
+		if err != nil {
+			l.Errorf("Unable to write recording of channel %s, recording stopped: %v\n", r.hash, err)
+			r.rs.stop(r)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		l.Errorf("Unable to save recording file %s: %v\n", r.path, err)
+		return
+	}
+	if err := f.Close(); err != nil {
+		l.Errorf("Unable to save recording file %s: %v\n", r.path, err)
+		return
+	}
+	r.mu.Lock()
+	dropped := r.dropped
+	r.mu.Unlock()
+	if dropped > 0 {
+		l.Warnf("Recording of channel %s is missing %d lines that could not be written in time.\n", r.hash, dropped)
+	}
+	l.Infof("Recording of channel %s saved to %s\n", r.hash, r.path)
+}
+
+// Record queues a line sent by the client to be written.
+// If RecordQueueSize records are waiting to be written, the line is dropped instead of delaying the channel.
+func (r *recorder) Record(sender *Client, line []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	now := time.Now()
+	rec := make([]byte, 0, len(line)+3*binary.MaxVarintLen64+1)
+	rec = binary.AppendUvarint(rec, uint64(now.Sub(r.last)/time.Microsecond))
+	rec = append(rec, recordDirection(sender.connectionType))
+	rec = binary.AppendUvarint(rec, sender.id)
+	rec = binary.AppendUvarint(rec, uint64(len(line)))
+	rec = append(rec, line...)
+	select {
+	case r.queue <- rec:
+		r.last = now
+	default:
+		r.dropped++
+	}
+}
+
+// Close stops the recorder. Queued records are still written, and the file is closed once they are.
+func (r *recorder) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+}
+
+// recordings are the channels whose traffic is recorded.
+// A recording file is created when the first line is sent in a recorded channel,
+// and closed when the channel is removed.
+type recordings struct {
+	mu       sync.Mutex
+	l        *Logger
+	dir      string
+	storeKey bool
+	channels map[string]*recorder
+	writers  sync.WaitGroup
+}
+
+// newRecordings records the traffic of channels to files in dir.
+// If storeKey is true, the channel key is stored in each recording, and not only its hash.
+func newRecordings(dir string, channels []string, storeKey bool, l *Logger) *recordings {
+	rs := &recordings{
+		l:        l,
+		dir:      dir,
+		storeKey: storeKey,
+		channels: make(map[string]*recorder),
+	}
+	for _, ch := range channels {
+		rs.channels[ch] = nil
+		l.Debugf("Traffic will be recorded for channel \"%s\"\n", ch)
+	}
+	return rs
+}
+
+func (rs *recordings) enabled(channel string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	_, ok := rs.channels[channel]
+	return ok
+}
+
+// record queues a line sent by the client to be written, if its channel is recorded.
+func (rs *recordings) record(sender *Client, line []byte) {
+	rs.mu.Lock()
+	r, ok := rs.channels[sender.channel]
+	if ok && r == nil {
+		r = rs.newRecorder(sender.channel)
+		rs.channels[sender.channel] = r
+	}
+	rs.mu.Unlock()
+	if r != nil {
+		r.Record(sender, line)
+	}
+}
+
+// stop stops recording the channel of r after it failed, if r is still its recorder.
+func (rs *recordings) stop(r *recorder) {
+	rs.mu.Lock()
+	if rs.channels[r.channel] == r {
+		delete(rs.channels, r.channel)
+	}
+	rs.mu.Unlock()
+	r.Close()
+}
+
+// closeChannel closes the recording file of the channel, if any.
+// The channel stays recorded, and a new file is created if it is used again.
+func (rs *recordings) closeChannel(channel string) {
+	rs.mu.Lock()
+	r := rs.channels[channel]
+	if r != nil {
+		rs.channels[channel] = nil
+	}
+	rs.mu.Unlock()
+	if r != nil {
+		r.Close()
+	}
+}
+
+// wait waits until every closed recording file has been written.
+func (rs *recordings) wait() {
+	rs.writers.Wait()
+}
+
+// set enables or disables recording for a channel.
+func (rs *recordings) set(channel string, enable bool) {
+	if !enable {
+		rs.closeChannel(channel)
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if enable {
+		if _, ok := rs.channels[channel]; !ok {
+			rs.channels[channel] = nil
+		}
+		return
+	}
+	delete(rs.channels, channel)
+}
+
+// list returns the recorded channels, sorted.
+func (rs *recordings) list() []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	channels := make([]string, 0, len(rs.channels))
+	for ch := range rs.channels {
+		channels = append(channels, ch)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// recordChannel enables or disables recording for a channel.
+func (s *Server) recordChannel(channel string, enable bool) {
+	s.record.set(channel, enable)
+	if enable {
+		s.l.Infof("Traffic will be recorded for channel \"%s\"\n", channel)
+		s.sendInterceptNotice(channel, nil)
+	} else {
+		s.l.Infof("Traffic will no longer be recorded for channel \"%s\"\n", channel)
+	}
+}
+
+// recordEntry is a single line read from a recording file.
+type recordEntry struct {
+	Delay     time.Duration
+	Direction byte
+	Sender    uint64
+	Line      []byte
+}
+
+// recordReader reads recording files.
+// Channel is empty unless the recording was made with -recordkey.
+type recordReader struct {
+	r           *bufio.Reader
+	Start       time.Time
+	ChannelHash string
+	Channel     string
+}
+
+func newRecordReader(rd io.Reader) (*recordReader, error) {
+	r := bufio.NewReader(rd)
+	magic := make([]byte, len(RecordMagic)+1)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic[:len(RecordMagic)]) != RecordMagic {
+		return nil, ErrRecordFormat
+	}
+	if magic[len(RecordMagic)] != RecordVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrRecordFormat, magic[len(RecordMagic)])
+	}
+	start, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := readRecordBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := readRecordBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	return &recordReader{
+		r:           r,
+		Start:       time.Unix(0, start),
+		ChannelHash: string(hash),
+		Channel:     string(channel),
+	}, nil
+}
+
+// Next reads the next entry, returning io.EOF at the end of the recording.
+func (rr *recordReader) Next() (recordEntry, error) {
+	var e recordEntry
+	delay, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return e, err
+	}
+	e.Delay = time.Duration(delay) * time.Microsecond
+	if e.Direction, err = rr.r.ReadByte(); err != nil {
+		return e, unexpectedEOF(err)
+	}
+	if e.Sender, err = binary.ReadUvarint(rr.r); err != nil {
+		return e, unexpectedEOF(err)
+	}
+	if e.Line, err = readRecordBytes(rr.r); err != nil {
+		return e, unexpectedEOF(err)
+	}
+	return e, nil
+}
+
+func readRecordBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > RecordMaxLine {
+		return nil, fmt.Errorf("%w: line of %d bytes is too long", ErrRecordFormat, n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// redactor removes sensitive fields from intercepted protocol data,
+// keeping message types and the size of each redacted value.
+type redactor struct {
+	// fields maps a message type to the fields redacted from it.
+	// Fields under the empty type are redacted from every message type.
+	fields map[string][]string
+}
+
+// newRedactor creates a redactor from a comma separated list of fields.
+// Each field is either "type:field", redacting the field from messages of that type,
+// or "field", redacting the field from every message.
+func newRedactor(spec string) *redactor {
+	r := &redactor{
+		fields: make(map[string][]string),
+	}
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		typ, field, ok := strings.Cut(f, ":")
+		if !ok {
+			typ, field = "", f
+		}
+		r.fields[typ] = append(r.fields[typ], field)
+	}
+	return r
+}
+
+// redact returns line with the configured fields replaced by a placeholder containing the size of the value,
+// including fields of nested objects and of objects in arrays.
+// If line is not a JSON object, only its size and, if it can be found, its message type are returned.
+// If r is nil, line is returned unchanged.
+func (r *redactor) redact(line []byte) []byte {
+	if r == nil {
+		return line
+	}
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return unparseable(line)
+	}
+	var typ string
+	_ = json.Unmarshal(msg["type"], &typ)
+
+	fields := make(map[string]struct{})
+	for _, f := range r.fields[""] {
+		fields[f] = struct{}{}
+	}
+	for _, f := range r.fields[typ] {
+		fields[f] = struct{}{}
+	}
+	if !redactObject(msg, fields) {
+		return bytes.TrimRight(line, "\r\n")
+	}
+	redacted, err := json.Marshal(msg)
+	if err != nil {
+		return unparseable(line)
+	}
+	return redacted
+}
+
+// channel returns channel as it is logged, which is its hash if r is not nil,
+// so that the channel key is not written to logs of intercepted protocol data.
+func (r *redactor) channel(channel string) string {
+	if r == nil || channel == "" {
+		return channel
+	}
+	return channelHash(channel)
+}
+
+// redactObject replaces the values of fields in obj, and in the objects nested in it, with a placeholder containing their size.
+// It reports whether anything was replaced.
+func redactObject(obj map[string]json.RawMessage, fields map[string]struct{}) bool {
+	changed := false
+	for k, v := range obj {
+		if _, ok := fields[k]; ok {
+			obj[k] = json.RawMessage(`"[redacted ` + strconv.Itoa(len(v)) + ` bytes]"`)
+			changed = true
+			continue
+		}
+		if nested, ok := redactValue(v, fields); ok {
+			obj[k] = nested
+			changed = true
+		}
+	}
+	return changed
+}
+
+// redactValue redacts fields from v if it is an object or an array, returning the redacted value and whether anything was replaced.
+func redactValue(v json.RawMessage, fields map[string]struct{}) (json.RawMessage, bool) {
+	v = bytes.TrimSpace(v)
+	if len(v) == 0 || (v[0] != '{' && v[0] != '[') {
+		return nil, false
+	}
+	var redacted any
+	if v[0] == '{' {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(v, &obj); err != nil || !redactObject(obj, fields) {
+			return nil, false
+		}
+		redacted = obj
+	} else {
+		var arr []json.RawMessage
+		if err := json.Unmarshal(v, &arr); err != nil {
+			return nil, false
+		}
+		changed := false
+		for i, elem := range arr {
+			if nested, ok := redactValue(elem, fields); ok {
+				arr[i] = nested
+				changed = true
+			}
+		}
+		if !changed {
+			return nil, false
+		}
+		redacted = arr
+	}
+	b, err := json.Marshal(redacted)
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// unparseableType finds the message type of a line that is not valid JSON, such as a truncated message.
+var unparseableType = regexp.MustCompile(`"type"\s*:\s*"([^"\\]{1,64})"`)
+
+// unparseable returns a placeholder for a line that is not a JSON object, containing its size and its message type if it can be found.
+func unparseable(line []byte) []byte {
+	if m := unparseableType.FindSubmatch(line); m != nil {
+		return []byte("[unparseable data of type " + strconv.Quote(string(m[1])) + ", " + strconv.Itoa(len(line)) + " bytes]")
+	}
+	return []byte("[unparseable data, " + strconv.Itoa(len(line)) + " bytes]")
+}
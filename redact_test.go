@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bufferSink collects log records in memory.
+type bufferSink struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *bufferSink) WriteLog(_ LogLevelStr, line []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.buf.Write(line)
+	return err
+}
+
+func (b *bufferSink) Reopen() error {
+	return nil
+}
+
+func (b *bufferSink) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRedactedInterceptOmitsChannelKey(t *testing.T) {
+	const key = "secret-channel-key"
+	old := interceptRedact
+	interceptRedact = true
+	defer func() { interceptRedact = old }()
+
+	for _, format := range []string{LogFormatText, LogFormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			l := NewLogger(LogLevelNone, format)
+			sink := &bufferSink{}
+			l.addOutput(LogLevelInfo, sink, false)
+			s, err := NewServer(newCertStore(tls.Certificate{}, nil, l), l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.intercept.setChannel(key, true)
+			c := &Client{srv: s, id: 1, channel: key, connectionType: TypeController, addr: "test"}
+
+			c.interceptData("Received from", []byte(`{"type":"join","channel":"`+key+`","connection_type":"master"}`))
+			c.interceptData("Sent to", []byte(`{"type":"key","vk_code":65,"pressed":true}`))
+			// The channel doesn't exist, as the client was never added to it.
+			s.SendLineToChannel(c, []byte(`{"type":"key","vk_code":65,"pressed":false}`), false)
+
+			out := sink.String()
+			if strings.Count(out, "Data: ") != 1 {
+				t.Fatalf("got log output %q, want the data sent to a non-existent channel", out)
+			}
+			if strings.Contains(out, key) {
+				t.Errorf("log output contains the channel key: %s", out)
+			}
+			if !strings.Contains(out, channelHash(key)) {
+				t.Errorf("log output doesn't identify the channel by its hash: %s", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// replayMain runs the replay subcommand with the given arguments, returning the exit code.
+//
+// The replay subcommand plays a recording made with -recordchannel.
+// With -addr, it joins a channel on a live server and sends the lines recorded from one connection type,
+// acting as that side of the original session.
+// Without -addr, it acts as a fake client, printing every recorded line to standard output.
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	var (
+		rAddr       string
+		fingerprint string
+		channel     string
+		connType    string
+		speed       float64
+	)
+	fs.StringVar(&rAddr, "addr", "", "Provide the address of a server to replay the recording into, connecting with TLS. Start the address with tcp:// or unix:// to connect to a listener with that scheme without TLS. If empty, the recording is printed to standard output.")
+	fs.StringVar(&fingerprint, "fingerprint", "", "Provide the SHA-256 fingerprint of the certificate of the server, which is otherwise not verified.")
+	fs.StringVar(&channel, "channel", "", "Provide the channel to join on the server. If empty, the recorded channel is used, if the recording was made with -recordkey.")
+	fs.StringVar(&connType, "type", TypeControlled, "Provide the connection type to join the channel with, "+TypeController+" or "+TypeControlled+". Only lines recorded from clients with this connection type are sent.")
+	fs.Float64Var(&speed, "speed", 1, "Provide the playback speed, such as 2 for twice the original speed. If 0, lines are played without delay.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] file\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || speed < 0 || (connType != TypeController && connType != TypeControlled) {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open recording: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	rr, err := newRecordReader(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read recording %s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	if channel == "" {
+		channel = rr.Channel
+	}
+
+	var play func(recordEntry) error
+	if rAddr == "" {
+		fmt.Printf("Recording of channel %s started at %s\n", rr.ChannelHash, rr.Start.Format(time.RFC3339))
+		elapsed := time.Duration(0)
+		play = func(e recordEntry) error {
+			elapsed += e.Delay
+			_, err := fmt.Printf("+%s from %s %d: %s\n", elapsed, recordDirectionString(e.Direction), e.Sender, bytesTrimDelimiter(e.Line))
+			return err
+		}
+	} else {
+		if channel == "" {
+			fmt.Fprintf(os.Stderr, "The recording doesn't contain the key of channel %s, which must be provided with -channel.\n", rr.ChannelHash)
+			return 2
+		}
+		conn, err := replayConnect(rAddr, fingerprint, channel, connType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to join channel \"%s\" at %s: %v\n", channel, rAddr, err)
+			return 1
+		}
+		defer conn.Close()
+		dir := recordDirection(connType)
+		play = func(e recordEntry) error {
+			if e.Direction != dir || replaySkip(e.Line) {
+				return nil
+			}
+			_, err := conn.Write(e.Line)
+			return err
+		}
+	}
+
+	for {
+		e, err := rr.Next()
+		if errors.Is(err, io.EOF) {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read recording %s: %v\n", fs.Arg(0), err)
+			return 1
+		}
+		if speed > 0 {
+			time.Sleep(time.Duration(float64(e.Delay) / speed))
+		}
+		if err := play(e); err != nil {
+			fmt.Fprintf(os.Stderr, "Replay failed: %v\n", err)
+			return 1
+		}
+	}
+}
+
+// replayConnect connects to a server and joins the channel.
+// Anything the server sends is discarded.
+func replayConnect(rAddr, fingerprint, channel, connType string) (net.Conn, error) {
+	conn, err := replayDial(rAddr, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(conn)
+	for _, msg := range []Msg{
+		{"type": TypeProtocolVersion, "version": 2},
+		{"type": TypeJoin, TypeChannel: channel, TypeConnectionType: connType},
+	} {
+		if err := enc.Encode(msg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	go func() {
+		_, _ = io.Copy(io.Discard, bufio.NewReader(conn))
+	}()
+	return conn, nil
+}
+
+// replayDial connects to a server at rAddr, with TLS unless rAddr starts with tcp:// or unix://.
+// If fingerprint is empty, the certificate of the server is not verified,
+// as replay is a debugging tool, and servers commonly use self-signed certificates.
+func replayDial(rAddr, fingerprint string) (net.Conn, error) {
+	scheme, addr, ok := strings.Cut(rAddr, "://")
+	if !ok {
+		scheme, addr = SchemeTLS, rAddr
+	}
+	switch scheme {
+	case SchemeTLS:
+	case SchemeTCP, SchemeUnix:
+		return net.Dial(scheme, addr)
+	default:
+		return nil, fmt.Errorf("%w: unknown scheme %s", ErrReplayAddr, scheme)
+	}
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if fingerprint != "" {
+		want := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if got := certFingerprint(cs.PeerCertificates[0]); got != want {
+				return fmt.Errorf("%w: got %s", ErrFingerprint, got)
+			}
+			return nil
+		}
+	}
+	return tls.Dial("tcp", addr, cfg)
+}
+
+// replaySkip reports whether a recorded line was generated by the server, and should not be replayed.
+func replaySkip(line []byte) bool {
+	var msg struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(line, &msg) != nil {
+		return false
+	}
+	return msg.Type == TypeClientJoined || msg.Type == TypeClientLeft
+}
+
+func recordDirectionString(dir byte) string {
+	switch dir {
+	case RecordFromController:
+		return TypeController
+	case RecordFromControlled:
+		return TypeControlled
+	default:
+		return "other"
+	}
+}
+
+func bytesTrimDelimiter(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == Delimiter {
+		b = b[:len(b)-1]
+	}
+	return b
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// newResumeToken returns a random token that a client can use to resume its session.
+func newResumeToken() string {
+	b := make([]byte, ResumeTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// holdClient keeps a client that disconnected in its channel for -resumegrace, buffering the messages sent to it,
+// so that it can resume its session from a new connection without the other clients seeing it leave.
+// It returns false if the client can't be held, and must be removed from its channel.
+// Clients that stopped responding are not held, as they would keep their place in the channel while nothing can reach them.
+func (s *Server) holdClient(c *Client) bool {
+	if resumeGrace <= 0 || c.resumeToken == "" || c.isDead() {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	c.mu.Lock()
+	c.held = true
+	c.mu.Unlock()
+	s.resumable[c.resumeToken] = c
+	c.resumeTimer = time.AfterFunc(resumeGrace, func() {
+		s.releaseClient(c)
+	})
+	c.log().Debugf("Client %s can resume its session for %s.\n", c.value(), resumeGrace)
+	return true
+}
+
+// releaseClient removes a held client from its channel, if it has not resumed its session.
+func (s *Server) releaseClient(c *Client) {
+	s.mu.Lock()
+	if s.resumable[c.resumeToken] != c {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.resumable, c.resumeToken)
+	c.resumeTimer.Stop()
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.held = false
+	c.resumeBuf = nil
+	c.mu.Unlock()
+	c.log().Debugf("Client %s did not resume its session.\n", c.value())
+	s.removeClient(c)
+}
+
+// resumeClient gives c the place of the held client with the resume token, with its ID, channel and connection type,
+// then sends it the messages that were buffered while the held client was disconnected.
+// It returns false if no client with the token is held, or c is not allowed to take its place.
+func (s *Server) resumeClient(c *Client, token string) bool {
+	s.mu.Lock()
+	old, ok := s.resumable[token]
+	if !ok || old.namespace != c.namespace || !s.clientAuth.allowed(c, old.channel) {
+		s.mu.Unlock()
+		return false
+	}
+	old.mu.Lock()
+	buf, overflowed := old.resumeBuf, old.resumeOverflowed
+	old.mu.Unlock()
+	if overflowed {
+		// Messages were lost, so the session can't be resumed. The held client is being released.
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.resumable, token)
+	old.resumeTimer.Stop()
+	old.mu.Lock()
+	old.held = false
+	old.resumeBuf = nil
+	old.mu.Unlock()
+
+	c.mu.Lock()
+	c.id = old.id
+	c.channel = old.channel
+	c.connectionType = old.connectionType
+	c.resumeToken = newResumeToken()
+	// Messages sent to the channel once the lock is released are buffered until the buffered messages are sent, so they arrive in order.
+	c.held = true
+	c.mu.Unlock()
+	delete(s.channels[c.channel], old)
+	s.channels[c.channel][c] = struct{}{}
+
+	var clients []Msg
+	var clientsID []uint64
+	for other := range s.channels[c.channel] {
+		if other != c && other.connectionType != c.connectionType {
+			clients = append(clients, other.AsMap())
+			clientsID = append(clientsID, other.id)
+		}
+	}
+	s.mu.Unlock()
+
+	joined, err := json.Marshal(Msg{
+		"type":          TypeChannelJoined,
+		TypeChannel:     c.requestedChannel(),
+		TypeUserIDs:     clientsID,
+		TypeClients:     clients,
+		TypeResumeToken: c.resumeToken,
+		TypeResumed:     true,
+	})
+	if err != nil {
+		c.log().Errorf("Invalid data type, failed to send Msg type to client %s: %v\n", c.value(), err)
+	}
+	c.sendResumed(append([][]byte{append(joined, Delimiter)}, buf...))
+
+	s.wh.Send(c.webhookEvent(EventClientResumed))
+	c.log().Event(EventClientResumed).Warnf("Client %s resumed the session of client ID %d, with %d buffered messages.\n", c.addr, c.id, len(buf))
+	return true
+}
+
+// bufferLine stores a line sent to a held client, to be sent when it resumes its session.
+// It returns false if the client is not held.
+// If more than ResumeBufferSize messages are sent to the client, the session can no longer be resumed, and the client is released.
+func (c *Client) bufferLine(line []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.held {
+		return false
+	}
+	if len(c.resumeBuf) >= ResumeBufferSize {
+		if !c.resumeOverflowed {
+			c.resumeOverflowed = true
+			// Releasing the client takes the lock of the server, which the sender may hold.
+			go c.srv.releaseClient(c)
+		}
+		return true
+	}
+	c.resumeBuf = append(c.resumeBuf, append([]byte(nil), line...))
+	return true
+}
+
+// sendResumed sends lines to a client that resumed a session, then the messages sent to it meanwhile, and stops buffering messages for it.
+// If too many messages were sent to it meanwhile, some were lost, so it is disconnected and removed from its channel.
+func (c *Client) sendResumed(lines [][]byte) {
+	for {
+		for _, line := range lines {
+			if err := c.w.Write(line); err != nil {
+				c.Close()
+				return
+			}
+		}
+		c.mu.Lock()
+		lines, c.resumeBuf = c.resumeBuf, nil
+		overflowed := c.resumeOverflowed
+		if len(lines) > 0 && !overflowed {
+			c.mu.Unlock()
+			continue
+		}
+		c.held = false
+		c.resumeOverflowed = false
+		c.mu.Unlock()
+		if overflowed {
+			c.log().Warnf("Client %s was sent too many messages while resuming its session, disconnecting.\n", c.value())
+			c.markDead()
+			c.disconnect()
+		}
+		return
+	}
+}
+
+// isHeld reports whether the client is disconnected and held for resuming its session.
+func (c *Client) isHeld() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.held
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	crand "crypto/rand"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"math/rand"
 	"net"
 	"strconv"
@@ -11,65 +15,196 @@ import (
 
 // Server provides a server using the protocol for NVDA's Remote Access feature.
 type Server struct {
-	l        *Logger
-	cfg      *tls.Config
-	mu       sync.RWMutex
-	channels map[string]Channel
-	nextID   uint
+	l          *Logger
+	cfg        *tls.Config
+	certs      *certStore
+	mu         sync.RWMutex
+	channels   map[string]Channel
+	nextID     uint64
+	ids        map[uint64]struct{}
+	wh         *webhook
+	intercept  *interceptTargets
+	redact     *redactor
+	record     *recordings
+	clientAuth *clientAuth
+	listeners  map[net.Listener]struct{}
+	sockets    map[string]net.Listener
+	clients    map[*Client]struct{}
+	active     sync.WaitGroup
+	closing    bool
+	resumable  map[string]*Client
+
+	monitorDone chan struct{}
+	monitorOnce sync.Once
 }
 
-// NewServer creates a server with the provided tls certificate and Logger.
-func NewServer(cert tls.Certificate, l *Logger) *Server {
+// NewServer creates a server with the provided certificate store and Logger.
+// New connections use the certificate held by certs at the time they connect.
+// An error is returned if the client certificate settings are not valid.
+func NewServer(certs *certStore, l *Logger) (*Server, error) {
 	cfg := &tls.Config{
-		Certificates:             []tls.Certificate{cert},
-		PreferServerCipherSuites: true,
-		MinVersion:               tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+
+	clientAuth, err := newClientAuth(cfg, l)
+	if err != nil {
+		return nil, err
+	}
+	if idStrategy != IDStrategySequential && idStrategy != IDStrategyRandom {
+		return nil, fmt.Errorf("%w: %s", ErrIDStrategy, idStrategy)
+	}
+
+	var redact *redactor
+	if interceptRedact {
+		redact = newRedactor(interceptRedactFields)
 	}
 
-	return &Server{
-		cfg:      cfg,
-		l:        l,
-		channels: make(map[string]Channel),
+	s := &Server{
+		cfg:        cfg,
+		certs:      certs,
+		l:          l,
+		channels:   make(map[string]Channel),
+		wh:         newWebhook(webhookURLs, webhookSecret, l),
+		intercept:  newInterceptTargets(interceptChannels, interceptClients, l),
+		redact:     redact,
+		record:     newRecordings(recordDir, recordChannels, recordKey, l),
+		clientAuth: clientAuth,
+		listeners:  make(map[net.Listener]struct{}),
+		sockets:    make(map[string]net.Listener),
+		clients:    make(map[*Client]struct{}),
+		resumable:  make(map[string]*Client),
+		ids:        make(map[uint64]struct{}),
+
+		monitorDone: make(chan struct{}),
 	}
+	l.OnRaise(s.levelRaised)
+	return s, nil
 }
 
 // Start starts the server with the provided listen address.
 // This can be called multiple times from different listen addresses.
 func (s *Server) Start(sAddr string) error {
-	s.l.Debugf("Attempting to start server with listen address %s\n", sAddr)
-	ln, err := net.Listen("tcp", sAddr)
+	ln, err := s.Listen(sAddr)
 	if err != nil {
-		s.l.Errorf("Listener error on %s: %s\n", sAddr, err)
 		return err
 	}
+	return s.Serve(ln)
+}
 
-	tcpLn, ok := ln.(*net.TCPListener)
-	if !ok {
-		s.l.Errorf("listener is not a TCP listener\n")
-		return ErrNotTCP
+// Listen creates a listener for the provided listen address, which must then be served with Serve.
+// The address can start with a scheme such as tcp:// to choose the type of listener, and end with options such as ?tlsmin=1.3.
+func (s *Server) Listen(sAddr string) (net.Listener, error) {
+	s.l.Debugf("Attempting to start server with listen address %s\n", sAddr)
+	spec, err := parseListenSpec(sAddr)
+	if err != nil {
+		s.l.Errorf("Listener error on %s: %s\n", sAddr, err)
+		return nil, err
 	}
 
-	if s.cfg == nil {
-		s.l.Errorf("listener is not a TLS listener\n")
-		return ErrNotTLS
+	done := make(chan struct{})
+	ln, err := s.listen(spec, done)
+	if err != nil {
+		close(done)
+		s.l.Errorf("Listener error on %s: %s\n", sAddr, err)
+		return nil, err
 	}
-
-	ln = tls.NewListener(tcpKeepAliveListener{tcpLn}, s.cfg)
-	defer ln.Close()
-	defer s.l.Infof("Server stopped at listening address %s\n", ln.Addr())
+	ln = &doneListener{Listener: ln, done: done}
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		ln.Close()
+		return nil, net.ErrClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.active.Add(1)
+	s.mu.Unlock()
 	s.l.Infof("Server started at listening address %s\n", ln.Addr())
+	return ln, nil
+}
+
+// Serve accepts connections on a listener created by Listen, until the listener is closed.
+// If the listener was closed by Shutdown, nil is returned.
+func (s *Server) Serve(ln net.Listener) error {
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+		ln.Close()
+		s.l.Infof("Server stopped at listening address %s\n", ln.Addr())
+		s.active.Done()
+	}()
 
 	for {
 		conn, connErr := ln.Accept()
 		if connErr != nil {
+			if errors.Is(connErr, net.ErrClosed) {
+				return nil
+			}
 			s.l.Errorf("Unable to accept connection at %s: %s\n", ln.Addr(), connErr)
-			break
+			return connErr
+		}
+
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
 		}
+		s.active.Add(1)
+		s.mu.Unlock()
 
-		client := NewClient(conn, s)
-		go client.handler()
+		// The client is created in its own goroutine, as reading the address of a connection from a proxy can block.
+		go func(conn net.Conn) {
+			defer s.active.Done()
+			client := NewClient(conn, s)
+			s.mu.Lock()
+			if s.closing {
+				s.mu.Unlock()
+				client.disconnect()
+			} else {
+				s.clients[client] = struct{}{}
+				s.mu.Unlock()
+			}
+			defer func() {
+				s.mu.Lock()
+				delete(s.clients, client)
+				s.mu.Unlock()
+			}()
+			client.handler()
+		}(conn)
 	}
-	return nil
+}
+
+// Shutdown stops the server, closing its listeners and disconnecting every client.
+// It returns once every listener has stopped and every client has been removed from its channel,
+// so recordings and webhook events for them are complete.
+func (s *Server) Shutdown() {
+	s.stopMonitoring()
+	s.mu.Lock()
+	s.closing = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	clients := make([]*Client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	held := make([]*Client, 0, len(s.resumable))
+	for _, c := range s.resumable {
+		held = append(held, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range held {
+		s.releaseClient(c)
+	}
+
+	// Clients are disconnected without holding the lock, as closing a client removes it from its channel.
+	for _, c := range clients {
+		c.disconnect()
+	}
+	s.active.Wait()
+	s.record.wait()
 }
 
 // SendMsgToChannel decodes Msg and sends it to the channel assigned to the given client.
@@ -81,7 +216,7 @@ func (s *Server) SendMsgToChannel(client *Client, msg Msg, encOrigin bool) {
 	}
 	line, err := json.Marshal(msg)
 	if err != nil {
-		s.l.Errorf("Invalid Msg type sent to channel from client: %s: %s\n", client.value(), err)
+		client.log().Errorf("Invalid Msg type sent to channel from client: %s: %s\n", client.value(), err)
 	}
 	line = append(line, Delimiter)
 	s.SendLineToChannel(client, line, encOrigin) // encOrigin is the value of sendNotConnected in this call
@@ -95,9 +230,10 @@ func (s *Server) SendLineToChannel(client *Client, line []byte, sendNotConnected
 	var sent bool
 	_, exist := s.channels[client.channel]
 	if !exist {
-		s.l.Interceptf("Attempted to send data to non-existent channel \"%s\"\nData: %s\n", client.channel, line)
+		client.interceptf("Attempted to send data to non-existent channel \"%s\"\nData: %s\n", s.redact.channel(client.channel), s.redact.redact(line))
 		return
 	}
+	s.record.record(client, line)
 	count := 0
 	for c := range s.channels[client.channel] {
 		if client != c && client.connectionType != c.connectionType {
@@ -115,8 +251,19 @@ func (s *Server) SendLineToChannel(client *Client, line []byte, sendNotConnected
 	}
 }
 
-func (s *Server) addClient(client *Client) {
-	client.id = s.getNextID()
+// addClient adds a client to its channel, giving it an ID.
+// If no ID can be given to it, an error is returned and the client is not added.
+func (s *Server) addClient(client *Client) error {
+	id, err := s.getNextID()
+	if err != nil {
+		return err
+	}
+	client.id = id
+	// If the client is intercepted by its ID, the clients already in its channel are notified, as their protocol data to the client is intercepted from now on.
+	notify := s.l.Level() < LogLevelDebug && s.intercept.hasClient(client.id) && !s.channelIntercepted(client.channel)
+	if resumeGrace > 0 {
+		client.resumeToken = newResumeToken()
+	}
 	s.SendMsgToChannel(client, Msg{
 		"type":     TypeClientJoined,
 		TypeUserID: client.id,
@@ -124,14 +271,16 @@ func (s *Server) addClient(client *Client) {
 	}, false)
 
 	s.mu.Lock()
+	created := false
 	if s.channels[client.channel] == nil {
 		s.channels[client.channel] = make(Channel)
-		s.l.Debugf("Channel created: \"%s\"\n", client.channel)
+		created = true
+		client.log().Event(EventChannelCreated).Debugf("Channel created: \"%s\"\n", client.channel)
 	}
 	s.channels[client.channel][client] = struct{}{}
 
 	var clients []Msg
-	var clientsID []uint
+	var clientsID []uint64
 
 	for c := range s.channels[client.channel] {
 		if c != client && c.connectionType != client.connectionType {
@@ -141,29 +290,46 @@ func (s *Server) addClient(client *Client) {
 	}
 	s.mu.Unlock()
 
-	client.SendMsg(Msg{
+	joined := Msg{
 		"type":      TypeChannelJoined,
-		TypeChannel: client.channel,
+		TypeChannel: client.requestedChannel(),
 		TypeUserIDs: clientsID,
 		TypeClients: clients,
-	})
+	}
+	if client.resumeToken != "" {
+		joined[TypeResumeToken] = client.resumeToken
+	}
+	client.SendMsg(joined)
 
-	if s.l.level >= LogLevelDebug {
-		s.l.Debugf("Client %s joined channel \"%s\" with connection type %s and received ID %d.\n", client.conn.RemoteAddr(), client.channel, client.connectionType, client.id)
+	if created {
+		s.wh.Send(webhookEvent{
+			Event:       EventChannelCreated,
+			ChannelHash: channelHash(client.channel),
+		})
+	}
+	s.wh.Send(client.webhookEvent(EventClientJoined))
+	if notify && !created {
+		s.sendInterceptNotice(client.channel, client)
+	}
+
+	if s.l.Level() >= LogLevelDebug {
+		client.log().Event(EventClientJoined).Debugf("Client %s joined channel \"%s\" with connection type %s and received ID %d.\n", client.addr, client.channel, client.connectionType, client.id)
 	} else {
-		s.l.Warnf("Client %s received ID %d.\n", client.conn.RemoteAddr(), client.id)
+		client.log().Event(EventClientJoined).Warnf("Client %s received ID %d.\n", client.addr, client.id)
 	}
+	return nil
 }
 
 func (s *Server) removeClient(client *Client) {
 	send := true
 	s.mu.Lock()
 	delete(s.channels[client.channel], client)
-	s.l.Debugf("Client %s left channel \"%s\"\n", client.value(), client.channel)
+	delete(s.ids, client.id)
+	client.log().Event(EventClientLeft).Debugf("Client %s left channel \"%s\"\n", client.value(), client.channel)
 	if len(s.channels[client.channel]) == 0 {
 		delete(s.channels, client.channel)
 		send = false
-		s.l.Debugf("Channel removed: \"%s\"\n", client.channel)
+		client.log().Event(EventChannelEmptied).Debugf("Channel removed: \"%s\"\n", client.channel)
 	}
 	s.mu.Unlock()
 
@@ -174,14 +340,24 @@ func (s *Server) removeClient(client *Client) {
 			TypeClient: client.AsMap(),
 		}, false)
 	}
+
+	s.wh.Send(client.webhookEvent(EventClientLeft))
+	if !send {
+		s.wh.Send(webhookEvent{
+			Event:       EventChannelEmptied,
+			ChannelHash: channelHash(client.channel),
+		})
+		s.record.closeChannel(client.channel)
+	}
 }
 
-func (s *Server) generateKey() (key string) {
+// generateKey generates a channel key that is not in use in the namespace of the client.
+func (s *Server) generateKey(client *Client) (key string) {
 	for {
 		key = strconv.Itoa(rand.Intn(90000000) + 10000000)
 		s.l.Debugf("Generated channel key: \"%s\"\n", key)
 		s.mu.RLock()
-		_, exist := s.channels[key]
+		_, exist := s.channels[client.qualifyChannel(key)]
 		s.mu.RUnlock()
 
 		if !exist {
@@ -192,10 +368,28 @@ func (s *Server) generateKey() (key string) {
 	}
 }
 
-func (s *Server) getNextID() uint {
+// getNextID returns the ID of a client joining a channel, using the strategy set with -idstrategy.
+// Random IDs are between 1 and MaxClientID, and unique among the clients in channels.
+// An error is returned if the system random number generator fails.
+func (s *Server) getNextID() (uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.nextID++
-	s.l.Debugf("Next ID retrieved: %d\n", s.nextID)
-	return s.nextID
+	if idStrategy != IDStrategyRandom {
+		s.nextID++
+		s.l.Debugf("Next ID retrieved: %d\n", s.nextID)
+		return s.nextID, nil
+	}
+	var b [8]byte
+	for {
+		if _, err := crand.Read(b[:]); err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrClientID, err)
+		}
+		id := binary.BigEndian.Uint64(b[:]) & MaxClientID
+		if _, used := s.ids[id]; id == 0 || used {
+			continue
+		}
+		s.ids[id] = struct{}{}
+		s.l.Debugf("Random ID retrieved: %d\n", id)
+		return id, nil
+	}
 }
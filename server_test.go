@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer creates a server with the default settings, and the client ID strategy set to strategy.
+func newTestServer(t *testing.T, strategy string) *Server {
+	t.Helper()
+	old := idStrategy
+	idStrategy = strategy
+	t.Cleanup(func() { idStrategy = old })
+	l := NewLogger(LogLevelNone, LogFormatText)
+	s, err := NewServer(newCertStore(tls.Certificate{}, nil, l), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestGetNextIDRandom(t *testing.T) {
+	s := newTestServer(t, IDStrategyRandom)
+	const goroutines, perGoroutine = 16, 500
+	ids := make(chan uint64, goroutines*perGoroutine)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				id, err := s.getNextID()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids <- id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[uint64]bool)
+	for id := range ids {
+		if id < 1 || id > MaxClientID {
+			t.Errorf("ID %d is not between 1 and %d", id, uint64(MaxClientID))
+		}
+		if seen[id] {
+			t.Errorf("ID %d was given more than once", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != goroutines*perGoroutine {
+		t.Errorf("got %d IDs, want %d", len(seen), goroutines*perGoroutine)
+	}
+}
+
+func TestGetNextIDSequential(t *testing.T) {
+	s := newTestServer(t, IDStrategySequential)
+	for want := uint64(1); want <= 3; want++ {
+		id, err := s.getNextID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != want {
+			t.Errorf("got ID %d, want %d", id, want)
+		}
+	}
+}
+
+func TestRemoveClientFreesID(t *testing.T) {
+	s := newTestServer(t, IDStrategyRandom)
+	id, err := s.getNextID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{srv: s, id: id, channel: "key", connectionType: TypeController, addr: "test"}
+	s.mu.Lock()
+	s.channels[c.channel] = Channel{c: {}}
+	s.mu.Unlock()
+
+	s.removeClient(c)
+	s.mu.RLock()
+	_, used := s.ids[id]
+	s.mu.RUnlock()
+	if used {
+		t.Errorf("ID %d is still in use after its client was removed", id)
+	}
+}
+
+func TestSilentClientDisconnected(t *testing.T) {
+	old := pingTimeout
+	pingTimeout = 200 * time.Millisecond
+	defer func() { pingTimeout = old }()
+	s := newTestServer(t, IDStrategySequential)
+	ln, err := s.Listen("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = s.Serve(ln)
+	}()
+	defer s.Shutdown()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, `{"type":"join","channel":"test","connection_type":"slave"}`+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	if _, err := r.ReadString(Delimiter); err != nil {
+		t.Fatalf("reading channel_joined: %v", err)
+	}
+
+	// Data sent before the timeout keeps the client connected.
+	time.Sleep(pingTimeout / 2)
+	if _, err := io.WriteString(conn, `{"type":"key","vk_code":65,"pressed":true}`+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	sent := time.Now()
+	time.Sleep(pingTimeout / 2)
+	s.mu.RLock()
+	n := len(s.channels["test"])
+	s.mu.RUnlock()
+	if n != 1 {
+		t.Fatalf("got %d clients in the channel before the timeout, want 1", n)
+	}
+
+	for {
+		if _, err := r.ReadString(Delimiter); err != nil {
+			break
+		}
+	}
+	if elapsed := time.Since(sent); elapsed < pingTimeout {
+		t.Errorf("disconnected %s after sending data, before the timeout of %s", elapsed, pingTimeout)
+	}
+}
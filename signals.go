@@ -0,0 +1,42 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// shutdownSignals are the signals that shut the server down gracefully.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// upgradeSignals are the signals that upgrade the server to a new server process.
+var upgradeSignals = []os.Signal{syscall.SIGHUP}
+
+// handleSignals handles signals sent to the server process in a goroutine.
+//
+// SIGUSR1 reopens log files, for use with external log rotation.
+// SIGUSR2 sets the log level of every log output to debug for the duration of -logleveltimeout,
+// or restores the log levels if they were already changed.
+func handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range ch {
+			switch sig {
+			case syscall.SIGUSR1:
+				logger.Infof("Received %s, reopening log files.\n", sig)
+				logger.Reopen()
+			case syscall.SIGUSR2:
+				if _, _, ok := logger.LevelOverride(); ok {
+					logger.ResetLevel()
+					logger.Infof("Received %s, log levels restored.\n", sig)
+					continue
+				}
+				logger.Infof("Received %s, changing log level.\n", sig)
+				logger.SetLevel(LogLevelDebug, logLevelTimeout)
+			}
+		}
+	}()
+}
@@ -0,0 +1,15 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// shutdownSignals are the signals that shut the server down gracefully.
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+// upgradeSignals are the signals that upgrade the server to a new server process.
+// Upgrades are not supported on these platforms.
+var upgradeSignals []os.Signal
+
+// handleSignals does nothing on platforms without user defined signals.
+func handleSignals() {}
@@ -0,0 +1,37 @@
+//go:build !windows && !plan9
+
+package main
+
+import "log/syslog"
+
+// syslogSink writes log records to the local syslog daemon.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink() (logSink, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, SyslogTag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{w: w}, nil
+}
+
+func (s syslogSink) WriteLog(level LogLevelStr, line []byte) error {
+	msg := string(line)
+	switch level {
+	case LogLevelError:
+		return s.w.Err(msg)
+	case LogLevelWarn:
+		return s.w.Warning(msg)
+	case LogLevelInfo:
+		return s.w.Info(msg)
+	default:
+		return s.w.Debug(msg)
+	}
+}
+
+// Reopen does nothing, the syslog writer reconnects on its own.
+func (s syslogSink) Reopen() error {
+	return nil
+}
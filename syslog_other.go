@@ -0,0 +1,7 @@
+//go:build windows || plan9
+
+package main
+
+func newSyslogSink() (logSink, error) {
+	return nil, ErrSyslogUnsupported
+}
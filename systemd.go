@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inheritedSockets are listening sockets passed to the server when it was started,
+// by systemd socket activation or by the server process it is upgrading.
+type inheritedSockets struct {
+	mu    sync.Mutex
+	files []*os.File
+	used  []bool
+}
+
+var (
+	sdActivated     *inheritedSockets
+	sdActivatedOnce sync.Once
+)
+
+// sdListenFDs returns the listening sockets passed to the server by systemd socket activation, as described in sd_listen_fds(3).
+// The environment variables describing them are removed, so they are not inherited by processes started by the server.
+func sdListenFDs() *inheritedSockets {
+	sdActivatedOnce.Do(func() {
+		sdActivated = &inheritedSockets{}
+		names := parseListenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+		if names == nil {
+			return
+		}
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+
+		for i, name := range names {
+			sdActivated.adopt(SystemdListenFDsStart+i, name)
+		}
+	})
+	return sdActivated
+}
+
+// parseListenFDs returns the names of the sockets described by the values of LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES,
+// in the order of their file descriptors. If the sockets were not passed to the process with ID self, nil is returned.
+func parseListenFDs(pid, fds, fdnames string, self int) []string {
+	if p, err := strconv.Atoi(pid); err != nil || p != self {
+		return nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	var given []string
+	if fdnames != "" {
+		given = strings.Split(fdnames, ":")
+	}
+	names := make([]string, n)
+	for i := range names {
+		// systemd names sockets unknown if the socket unit does not set FileDescriptorName.
+		names[i] = "unknown"
+		if i < len(given) && given[i] != "" {
+			names[i] = given[i]
+		}
+	}
+	return names
+}
+
+// defaultAddrs returns the listening addresses used when none are provided.
+// If the server is upgrading another server process, the addresses of that process are used.
+// If the server was started by systemd socket activation, each socket passed by systemd is used as a TLS listener.
+func defaultAddrs() stringList {
+	if upgraded := upgradeListenFDs(); len(upgraded.files) > 0 {
+		var addrs stringList
+		for _, f := range upgraded.files {
+			if !strings.HasPrefix(f.Name(), adminSocketPrefix) {
+				addrs = append(addrs, f.Name())
+			}
+		}
+		return addrs
+	}
+	sockets := sdListenFDs()
+	if len(sockets.files) == 0 {
+		return stringList{DefaultAddr}
+	}
+	var addrs stringList
+	for i := range sockets.files {
+		addrs = append(addrs, SchemeTLS+"://?fd="+strconv.Itoa(SystemdListenFDsStart+i))
+	}
+	return addrs
+}
+
+// adopt adds the inherited socket with file descriptor fd.
+// The file descriptor is closed on exec, so the socket is only passed to processes started by the server on purpose.
+func (ss *inheritedSockets) adopt(fd int, name string) {
+	closeOnExec(fd)
+	ss.files = append(ss.files, os.NewFile(uintptr(fd), name))
+	ss.used = append(ss.used, false)
+}
+
+// closeUnused closes the inherited sockets that no listener was created for, so they don't stay open for the life of the server.
+func (ss *inheritedSockets) closeUnused(l *Logger) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for i, f := range ss.files {
+		if ss.used[i] {
+			continue
+		}
+		l.Warnf("Closing inherited socket %d named %s, as no listening address uses it.\n", SystemdListenFDsStart+i, f.Name())
+		f.Close()
+		ss.used[i] = true
+	}
+}
+
+// listener returns a listener for an inherited socket, given by its file descriptor number, such as 3,
+// or by its name, which for sockets passed by systemd is set with FileDescriptorName in the socket unit.
+// If several sockets have the same name, each call returns the next unused one.
+func (ss *inheritedSockets) listener(fd string) (net.Listener, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for i, f := range ss.files {
+		if ss.used[i] || (fd != strconv.Itoa(SystemdListenFDsStart+i) && fd != f.Name()) {
+			continue
+		}
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("inherited socket %s: %w", fd, err)
+		}
+		// FileListener uses a copy of the file descriptor, so the original is no longer needed.
+		f.Close()
+		ss.used[i] = true
+		return ln, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrListenFD, fd)
+}
+
+// sdNotify sends a notification such as READY=1 to the service manager, as described in sd_notify(3).
+// Several notifications can be sent at once, separated by newlines.
+// If the server was not started by a service manager that accepts notifications, nothing is sent.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// An address starting with @ is in the abstract namespace, which the net package handles.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdog returns how often the service manager expects WATCHDOG=1 notifications, or 0 if the watchdog is not enabled for the server.
+func sdWatchdog() time.Duration {
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 63)
+	if err != nil || usec == 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifySystemd tells the service manager that the server is ready, then keeps its status text up to date until done is closed.
+// If the watchdog is enabled, WATCHDOG=1 is sent at half of the watchdog interval, as recommended by sd_watchdog_enabled(3).
+func (s *Server) notifySystemd(done <-chan struct{}) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	status := s.status()
+	if err := sdNotify("READY=1\nSTATUS=" + status); err != nil {
+		s.l.Errorf("Unable to notify systemd: %v\n", err)
+		return
+	}
+	s.l.Debugf("Notified systemd that the server is ready.\n")
+
+	interval := SystemdStatusInterval
+	watchdog := sdWatchdog()
+	if watchdog > 0 && watchdog/2 < interval {
+		interval = watchdog / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		var states []string
+		if watchdog > 0 {
+			states = append(states, "WATCHDOG=1")
+		}
+		if st := s.status(); st != status {
+			status = st
+			states = append(states, "STATUS="+status)
+		}
+		if len(states) == 0 {
+			continue
+		}
+		if err := sdNotify(strings.Join(states, "\n")); err != nil {
+			s.l.Errorf("Unable to notify systemd: %v\n", err)
+		}
+	}
+}
+
+// status returns a description of the clients and channels on the server, for the status text shown by systemctl status.
+func (s *Server) status() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fmt.Sprintf("Clients: %d, channels: %d", len(s.clients), len(s.channels))
+}
@@ -0,0 +1,194 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseListenFDs(t *testing.T) {
+	tests := []struct {
+		name              string
+		pid, fds, fdnames string
+		self              int
+		want              []string
+	}{
+		{"named", "100", "2", "tls:admin", 100, []string{"tls", "admin"}},
+		{"unnamed", "100", "2", "", 100, []string{"unknown", "unknown"}},
+		{"fewer names", "100", "3", "tls::", 100, []string{"tls", "unknown", "unknown"}},
+		{"other process", "101", "2", "tls:admin", 100, nil},
+		{"no pid", "", "2", "", 100, nil},
+		{"no sockets", "100", "0", "", 100, nil},
+		{"invalid count", "100", "two", "", 100, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseListenFDs(tt.pid, tt.fds, tt.fdnames, tt.self); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// inheritSockets returns n listening sockets named name, as if they were inherited, with their addresses.
+func inheritSockets(t *testing.T, n int, name string) (*inheritedSockets, []string) {
+	t.Helper()
+	ss := &inheritedSockets{}
+	var addrs []string
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := ln.(*net.TCPListener).File()
+		ln.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := syscall.Dup(int(f.Fd()))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, ln.Addr().String())
+		ss.adopt(fd, name)
+	}
+	return ss, addrs
+}
+
+func TestInheritedSocketsListener(t *testing.T) {
+	ss, addrs := inheritSockets(t, 2, "tls")
+
+	// Sockets with the same name are returned in order.
+	for _, want := range addrs {
+		ln, err := ss.listener("tls")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ln.Addr().String(); got != want {
+			t.Errorf("got socket %s, want %s", got, want)
+		}
+		ln.Close()
+	}
+	if _, err := ss.listener("tls"); !errors.Is(err, ErrListenFD) {
+		t.Errorf("got %v for a name without unused sockets, want %v", err, ErrListenFD)
+	}
+	if _, err := ss.listener(strconv.Itoa(SystemdListenFDsStart)); !errors.Is(err, ErrListenFD) {
+		t.Errorf("got %v for a used file descriptor, want %v", err, ErrListenFD)
+	}
+}
+
+func TestInheritedSocketsCloseUnused(t *testing.T) {
+	ss, addrs := inheritSockets(t, 2, "tls")
+	ln, err := ss.listener("tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ss.closeUnused(NewLogger(LogLevelNone, LogFormatText))
+
+	if _, err := ss.listener("tls"); !errors.Is(err, ErrListenFD) {
+		t.Errorf("got %v for a closed socket, want %v", err, ErrListenFD)
+	}
+	if _, err := ss.files[1].Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("got %v for the file of the unused socket, want %v", err, os.ErrClosed)
+	}
+	// The claimed socket still accepts connections.
+	conn, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// listenNotify listens for notifications on a datagram socket, and sets NOTIFY_SOCKET to its address.
+func listenNotify(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("reading notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	conn := listenNotify(t)
+	if err := sdNotify("READY=1\nSTATUS=test"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readNotify(t, conn), "READY=1\nSTATUS=test"; got != want {
+		t.Errorf("got notification %q, want %q", got, want)
+	}
+}
+
+func TestSdNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("got %v without a notification socket, want nil", err)
+	}
+}
+
+func TestNotifySystemd(t *testing.T) {
+	conn := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	s := &Server{
+		l:        NewLogger(LogLevelNone, LogFormatText),
+		channels: make(map[string]Channel),
+		clients:  make(map[*Client]struct{}),
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		s.notifySystemd(done)
+		close(stopped)
+	}()
+
+	if got, want := readNotify(t, conn), "READY=1\nSTATUS=Clients: 0, channels: 0"; got != want {
+		t.Errorf("got notification %q, want %q", got, want)
+	}
+	if got, want := readNotify(t, conn), "WATCHDOG=1"; got != want {
+		t.Errorf("got notification %q, want %q", got, want)
+	}
+	close(done)
+	<-stopped
+}
+
+func TestSdWatchdog(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if got, want := sdWatchdog(), 30*time.Second; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if got := sdWatchdog(); got != 0 {
+		t.Errorf("got %s for the watchdog of another process, want 0", got)
+	}
+	t.Setenv("WATCHDOG_USEC", "0")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := sdWatchdog(); got != 0 {
+		t.Errorf("got %s for a disabled watchdog, want 0", got)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tlsVersions are the TLS versions that can be configured, by name.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the curves that can be configured for key exchange, by name.
+var tlsCurves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+// tlsPolicy is the TLS versions, cipher suites and curves a listener accepts.
+type tlsPolicy struct {
+	minVersion uint16
+	maxVersion uint16
+	ciphers    []*tls.CipherSuite
+	curves     []tls.CurveID
+}
+
+// parseTLSPolicy parses a TLS policy.
+// The versions are names such as 1.2 or 1.3, and an empty maximum version allows the highest supported version.
+// The cipher suites and curves are comma separated lists of names, such as TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 or X25519.
+// If a list is empty, the defaults of the Go TLS library are used.
+func parseTLSPolicy(minVersion, maxVersion, ciphers, curves string) (tlsPolicy, error) {
+	var p tlsPolicy
+	var ok bool
+	if p.minVersion, ok = tlsVersions[minVersion]; !ok {
+		return p, fmt.Errorf("%w: unknown TLS version %s", ErrTLSPolicy, minVersion)
+	}
+	if maxVersion != "" {
+		if p.maxVersion, ok = tlsVersions[maxVersion]; !ok {
+			return p, fmt.Errorf("%w: unknown TLS version %s", ErrTLSPolicy, maxVersion)
+		}
+		if p.maxVersion < p.minVersion {
+			return p, fmt.Errorf("%w: maximum TLS version %s is lower than minimum TLS version %s", ErrTLSPolicy, maxVersion, minVersion)
+		}
+	}
+
+	for _, name := range splitList(ciphers) {
+		cs := cipherSuiteByName(name)
+		if cs == nil {
+			return p, fmt.Errorf("%w: unknown cipher suite %s", ErrTLSPolicy, name)
+		}
+		p.ciphers = append(p.ciphers, cs)
+	}
+	for _, name := range splitList(curves) {
+		id, ok := tlsCurves[strings.ToLower(name)]
+		if !ok {
+			return p, fmt.Errorf("%w: unknown curve %s", ErrTLSPolicy, name)
+		}
+		p.curves = append(p.curves, id)
+	}
+	return p, nil
+}
+
+// apply sets the policy on cfg.
+func (p tlsPolicy) apply(cfg *tls.Config) {
+	cfg.MinVersion = p.minVersion
+	cfg.MaxVersion = p.maxVersion
+	cfg.CipherSuites = nil
+	for _, cs := range p.ciphers {
+		// The cipher suites of TLS 1.3 are not configurable, and are always enabled with it.
+		if supportsVersion(cs, tls.VersionTLS12) {
+			cfg.CipherSuites = append(cfg.CipherSuites, cs.ID)
+		}
+	}
+	cfg.CurvePreferences = p.curves
+}
+
+// String returns a description of the policy for logging.
+func (p tlsPolicy) String() string {
+	var b strings.Builder
+	b.WriteString("versions " + tlsVersionName(p.minVersion) + " to ")
+	if p.maxVersion == 0 {
+		b.WriteString(tlsVersionName(tls.VersionTLS13))
+	} else {
+		b.WriteString(tlsVersionName(p.maxVersion))
+	}
+	b.WriteString(", cipher suites ")
+	if len(p.ciphers) == 0 {
+		b.WriteString("default")
+	} else {
+		names := make([]string, len(p.ciphers))
+		for i, cs := range p.ciphers {
+			names[i] = cs.Name
+		}
+		b.WriteString(strings.Join(names, ", "))
+	}
+	b.WriteString(", curves ")
+	if len(p.curves) == 0 {
+		b.WriteString("default")
+	} else {
+		names := make([]string, len(p.curves))
+		for i, id := range p.curves {
+			names[i] = id.String()
+		}
+		b.WriteString(strings.Join(names, ", "))
+	}
+	return b.String()
+}
+
+// check returns problems with the policy, such as insecure cipher suites,
+// or no cipher suite that can be used with the private key of the certificate.
+func (p tlsPolicy) check(cert *tls.Certificate) []string {
+	var problems []string
+	if p.minVersion < tls.VersionTLS12 {
+		problems = append(problems, "TLS versions below 1.2 are enabled, which are deprecated")
+	}
+	for _, cs := range p.ciphers {
+		if cs.Insecure {
+			problems = append(problems, "cipher suite "+cs.Name+" is insecure")
+		}
+	}
+	if len(p.ciphers) == 0 {
+		return problems
+	}
+	if p.minVersion == tls.VersionTLS13 {
+		return append(problems, "cipher suites only apply to TLS 1.2 and below, and are ignored when the minimum TLS version is 1.3")
+	}
+	if p.maxVersion == 0 || p.maxVersion == tls.VersionTLS13 {
+		// Clients supporting TLS 1.3 can always connect with its cipher suites.
+		return problems
+	}
+	for _, cs := range p.ciphers {
+		if p.suiteUsable(cs) && cipherMatchesKey(cs, cert) {
+			return problems
+		}
+	}
+	return append(problems, "no configured cipher suite can be used with the certificate, so no client will be able to connect")
+}
+
+// suiteUsable reports whether the cipher suite supports any of the enabled TLS versions.
+func (p tlsPolicy) suiteUsable(cs *tls.CipherSuite) bool {
+	maxVersion := p.maxVersion
+	if maxVersion == 0 {
+		maxVersion = tls.VersionTLS13
+	}
+	for _, v := range cs.SupportedVersions {
+		if v >= p.minVersion && v <= maxVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// cipherMatchesKey reports whether the cipher suite can be used with the private key of the certificate in TLS 1.2 and below.
+func cipherMatchesKey(cs *tls.CipherSuite, cert *tls.Certificate) bool {
+	if cert == nil {
+		return true
+	}
+	switch cert.PrivateKey.(type) {
+	case *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return strings.Contains(cs.Name, "_ECDSA_")
+	case *rsa.PrivateKey:
+		return !strings.Contains(cs.Name, "_ECDSA_")
+	default:
+		return true
+	}
+}
+
+// tlsVersionName returns the name of a TLS version, such as TLS 1.3.
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return "TLS " + name
+		}
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+func supportsVersion(cs *tls.CipherSuite, version uint16) bool {
+	for _, v := range cs.SupportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// cipherSuiteByName returns the cipher suite with the given name, or nil if there is none.
+func cipherSuiteByName(name string) *tls.CipherSuite {
+	for _, list := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, cs := range list {
+			if strings.EqualFold(cs.Name, name) {
+				return cs
+			}
+		}
+	}
+	return nil
+}
+
+// rotateTicketKeys replaces the session ticket key of cfg every interval, until done is closed.
+// Previous keys are kept for TLSTicketKeys intervals, so that sessions can still be resumed shortly after a rotation.
+func rotateTicketKeys(cfg *tls.Config, interval time.Duration, done <-chan struct{}, l *Logger) {
+	var keys [][32]byte
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			l.Errorf("Unable to generate a session ticket key: %v\n", err)
+		} else {
+			keys = append([][32]byte{key}, keys...)
+			if len(keys) > TLSTicketKeys {
+				keys = keys[:TLSTicketKeys]
+			}
+			cfg.SetSessionTicketKeys(keys)
+			l.Debugf("Session ticket key rotated.\n")
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// splitList splits a comma separated list, ignoring spaces and empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,20 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"sync"
+	"syscall"
+)
+
+var umaskMu sync.Mutex
+
+// withUmask calls fn with the file mode creation mask of the process set to mask, and restores it afterwards.
+// The mask applies to the whole process, so files created by other goroutines while fn runs also get it.
+func withUmask(mask int, fn func() error) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return fn()
+}
@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package main
+
+// withUmask calls fn. These platforms have no file mode creation mask.
+func withUmask(mask int, fn func() error) error {
+	return fn()
+}
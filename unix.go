@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"sync/atomic"
+)
+
+// unixListener accepts connections on a Unix domain socket.
+// Connections on a Unix domain socket have no remote address,
+// so each one is given an address made of the socket path and a connection number, for use in logs.
+type unixListener struct {
+	net.Listener
+	path string
+	seq  atomic.Uint64
+}
+
+// Accept implements net.Listener for unixListener.
+func (ln *unixListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return unixConn{
+		Conn: conn,
+		addr: unixPeerAddr(ln.path + "#" + strconv.FormatUint(ln.seq.Add(1), 10)),
+	}, nil
+}
+
+type unixConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+// RemoteAddr implements net.Conn for unixConn.
+func (c unixConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// unixPeerAddr identifies a connection on a Unix domain socket.
+type unixPeerAddr string
+
+func (a unixPeerAddr) Network() string { return "unix" }
+func (a unixPeerAddr) String() string  { return string(a) }
+
+// listenUnix creates a listener on a Unix domain socket without TLS, for local clients.
+// Access is controlled with the permissions of the socket file, set with the mode and group options.
+// A socket file left behind by a server that is no longer running is replaced.
+// If the fd option is set, the socket passed by systemd is used, and its permissions are left to the socket unit.
+// The permissions of a socket passed by the server process being upgraded are also left unchanged.
+func (s *Server) listenUnix(spec listenSpec) (net.Listener, error) {
+	mode, err := strconv.ParseUint(spec.option("mode", "0600"), 8, 32)
+	if err != nil || mode > 0o777 {
+		return nil, fmt.Errorf("%w: mode must be octal permissions such as 0660", ErrListenSpec)
+	}
+	gid := -1
+	if group := spec.option("group", ""); group != "" {
+		if gid, err = lookupGroup(group); err != nil {
+			return nil, err
+		}
+	}
+
+	created := false
+	ln, err := s.socket(spec.orig, func() (net.Listener, error) {
+		if fd := spec.option("fd", ""); fd != "" {
+			return sdListenFDs().listener(fd)
+		}
+		if err := removeStaleSocket(spec.addr); err != nil {
+			return nil, err
+		}
+		created = true
+		// The socket is created accessible only to the user of the server, so no one else can connect before its permissions are set.
+		var ln net.Listener
+		err := withUmask(0o177, func() (err error) {
+			ln, err = net.Listen("unix", spec.addr)
+			return err
+		})
+		return ln, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ln.(*net.UnixListener); !ok {
+		ln.Close()
+		return nil, fmt.Errorf("%w: inherited socket for %s is not a Unix domain socket", ErrListenSpec, spec.orig)
+	}
+	if !created {
+		s.l.Infof("Listener %s uses an inherited Unix domain socket.\n", ln.Addr())
+		return &unixListener{Listener: ln, path: ln.Addr().String()}, nil
+	}
+
+	// The group is set before the permissions, so they are never granted to the previous group of the socket.
+	if gid >= 0 {
+		if err := os.Chown(spec.addr, -1, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if err := os.Chmod(spec.addr, fs.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	s.l.Infof("Listener %s uses a Unix domain socket with mode %04o.\n", spec.addr, mode)
+	return &unixListener{Listener: ln, path: spec.addr}, nil
+}
+
+// lookupGroup returns the ID of a group given by name or number.
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// removeStaleSocket removes the socket file at path if no server is listening on it.
+// An error is returned if the file is not a socket, or a server is listening on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%w: %s exists and is not a socket", ErrListenSpec, path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: %s is in use", ErrListenSpec, path)
+	}
+	return os.Remove(path)
+}
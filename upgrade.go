@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adminSocketPrefix starts the key of the admin API listener among the sockets passed in an upgrade,
+// which are otherwise keyed by their listening address.
+const adminSocketPrefix = "admin="
+
+var (
+	upgradeSockets     *inheritedSockets
+	upgradeSocketsOnce sync.Once
+)
+
+// upgradeListenFDs returns the listening sockets passed by the server process this server is upgrading, named by their keys.
+// The environment variables describing them are removed, so they are not inherited by processes started by the server.
+func upgradeListenFDs() *inheritedSockets {
+	upgradeSocketsOnce.Do(func() {
+		upgradeSockets = &inheritedSockets{}
+		v := os.Getenv(UpgradeListenersEnv)
+		if v == "" {
+			return
+		}
+		os.Unsetenv(UpgradeListenersEnv)
+		var keys []string
+		if err := json.Unmarshal([]byte(v), &keys); err != nil {
+			return
+		}
+		for i, key := range keys {
+			upgradeSockets.adopt(SystemdListenFDsStart+i, key)
+		}
+	})
+	return upgradeSockets
+}
+
+// upgradeReady tells the server process this server is upgrading that it accepts connections on all of its listeners.
+// If the server is not upgrading another process, nothing is done.
+func upgradeReady() error {
+	v := os.Getenv(UpgradeReadyEnv)
+	if v == "" {
+		return nil
+	}
+	os.Unsetenv(UpgradeReadyEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%w: invalid %s", ErrUpgrade, UpgradeReadyEnv)
+	}
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// socket returns the listening socket for key, passed by the server process this server is upgrading, or creates it with create.
+// The socket is recorded with its key, so that it can be passed on when this server is upgraded.
+func (s *Server) socket(key string, create func() (net.Listener, error)) (net.Listener, error) {
+	ln, err := upgradeListenFDs().listener(key)
+	if err != nil {
+		if ln, err = create(); err != nil {
+			return nil, err
+		}
+	} else {
+		s.l.Debugf("Using listening socket for %s from the previous server process.\n", key)
+	}
+	s.mu.Lock()
+	s.sockets[key] = ln
+	s.mu.Unlock()
+	return ln, nil
+}
+
+// Upgrade starts a new server process from the executable of the server, with the same arguments,
+// and passes it the listening sockets of the server.
+// It returns once the new process accepts connections on all of them, after which the server should be drained.
+// If the new process exits or does not become ready within UpgradeTimeout, it is stopped and an error is returned.
+func (s *Server) Upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.sockets))
+	for key := range s.sockets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	files := make([]*os.File, 0, len(keys)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, key := range keys {
+		filer, ok := s.sockets[key].(interface{ File() (*os.File, error) })
+		if !ok {
+			s.mu.RUnlock()
+			return fmt.Errorf("%w: listener %s can't be passed to another process", ErrUpgrade, key)
+		}
+		f, err := filer.File()
+		if err != nil {
+			s.mu.RUnlock()
+			return err
+		}
+		files = append(files, f)
+	}
+	s.mu.RUnlock()
+	keysJSON, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	var env []string
+	for _, kv := range os.Environ() {
+		// The new process sends its own watchdog notifications.
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		UpgradeListenersEnv+"="+string(keysJSON),
+		UpgradeReadyEnv+"="+strconv.Itoa(SystemdListenFDsStart+len(keys)),
+	)
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = env
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Close the write end of the pipe, so that reading from it fails if the new process exits without writing to it.
+	w.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			_ = cmd.Wait()
+			return fmt.Errorf("%w: new server process exited before it was ready: %s", ErrUpgrade, cmd.ProcessState)
+		}
+	case <-time.After(UpgradeTimeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("%w: new server process was not ready within %s", ErrUpgrade, UpgradeTimeout)
+	}
+	go func() {
+		_ = cmd.Wait()
+	}()
+
+	s.l.Infof("New server process %d accepts connections, passed %d listening sockets.\n", cmd.Process.Pid, len(keys))
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		s.l.Errorf("Unable to notify systemd: %v\n", err)
+	}
+	return nil
+}
+
+// Drain stops the server from accepting connections, leaving connected clients in their channels.
+// The returned channel is closed once every client has disconnected.
+// Unix domain socket files are kept, as the sockets are still used by the process the server was upgraded to.
+func (s *Server) Drain() <-chan struct{} {
+	s.stopMonitoring()
+	s.mu.Lock()
+	for _, sock := range s.sockets {
+		if ul, ok := sock.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	// Closing the sockets also stops listeners that are not served by Serve, such as the admin API.
+	for _, sock := range s.sockets {
+		sock.Close()
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(drained)
+	}()
+	return drained
+}
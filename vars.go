@@ -3,11 +3,47 @@ package main
 import "time"
 
 const (
-	ReadBufSize           = 65536
-	WriteBufSize          = 1024
-	KeepAlivePeriod       = time.Second * 15
-	WriteDeadlineDuration = time.Second * 4
-	Delimiter             = '\n'
+	ReadBufSize               = 65536
+	WriteBufSize              = 1024
+	KeepAlivePeriod           = time.Second * 15
+	WriteDeadlineDuration     = time.Second * 4
+	Delimiter                 = '\n'
+	LogFileTimeFormat         = "2006-01-02T15-04-05.000"
+	SyslogTag                 = "nvdaremoteserver"
+	AdminTimeout              = time.Second * 10
+	CertCheckInterval         = time.Hour * 12
+	CertCAValidity            = time.Hour * 24 * 365 * 20
+	DefaultAddr               = ":6837"
+	TLSTicketKeys             = 3
+	ProxyHeaderTimeout        = time.Second * 10
+	ProxyV1MaxLength          = 107
+	WebSocketHandshakeTimeout = time.Second * 10
+	WebSocketMaxMessageSize   = 1 << 20
+	SystemdListenFDsStart     = 3
+	SystemdStatusInterval     = time.Second * 10
+	UpgradeTimeout            = time.Second * 30
+	UpgradeListenersEnv       = "NVDAREMOTE_UPGRADE_LISTENERS"
+	UpgradeReadyEnv           = "NVDAREMOTE_UPGRADE_READY"
+	ResumeBufferSize          = WriteBufSize / 2
+	ResumeTokenBytes          = 16
+
+	WebhookQueueSize       = 256
+	WebhookTimeout         = time.Second * 10
+	WebhookRetries         = 5
+	WebhookBackoff         = time.Second
+	WebhookMaxBackoff      = time.Second * 30
+	WebhookSignatureHeader = "X-NVDARemote-Signature"
+	ChannelHashBytes       = 8
+
+	// event types, used in webhook notifications and structured logs.
+	EventClientConnected    = "client_connected"
+	EventClientDisconnected = "client_disconnected"
+	EventKeyGenerated       = "key_generated"
+	EventClientJoined       = "client_joined"
+	EventClientLeft         = "client_left"
+	EventChannelCreated     = "channel_created"
+	EventChannelEmptied     = "channel_emptied"
+	EventClientResumed      = "client_resumed"
 
 	// protocol types.
 	TypeJoin             = "join"
@@ -26,6 +62,10 @@ const (
 	TypeClients          = "clients"
 	TypeConnectionType   = "connection_type"
 	TypeNvdaNotConnected = "nvda_not_connected"
+	TypePing             = "ping"
+	TypeResume           = "resume"
+	TypeResumeToken      = "resume_token"
+	TypeResumed          = "resumed"
 	TypeController       = "master"
 	TypeControlled       = "slave"
 )
@@ -43,9 +83,52 @@ type Handshake struct {
 	Channel        string `json:"channel,omitempty"`
 	ConnectionType string `json:"connection_type,omitempty"`
 	Version        int    `json:"version,omitempty"`
+	ResumeToken    string `json:"resume_token,omitempty"`
 }
 
+// Key types for generated certificates.
+const (
+	CertKeyECDSAP256 = "ecdsa-p256"
+	CertKeyECDSAP384 = "ecdsa-p384"
+	CertKeyECDSAP521 = "ecdsa-p521"
+	CertKeyEd25519   = "ed25519"
+	CertKeyRSA2048   = "rsa2048"
+	CertKeyRSA4096   = "rsa4096"
+)
+
+// Schemes of listening addresses.
+const (
+	SchemeTLS  = "tls"
+	SchemeTCP  = "tcp"
+	SchemeWS   = "ws"
+	SchemeWSS  = "wss"
+	SchemeUnix = "unix"
+)
+
+// Client certificate modes for -clientauth.
+const (
+	ClientAuthRequire  = "require"
+	ClientAuthOptional = "optional"
+)
+
+// Strategies for assigning client IDs.
+const (
+	IDStrategySequential = "sequential"
+	IDStrategyRandom     = "random"
+	// MaxClientID is the largest integer a JSON number can represent exactly, as a 64-bit float.
+	MaxClientID = 1<<53 - 1
+)
+
+// DefaultRedactFields are the fields redacted from intercepted protocol data when redaction is enabled.
+const DefaultRedactFields = "channel,key,set_clipboard_text:text,speak:sequence,display:cells,key:vk_code,key:scan_code,braille_input:name"
+
+// InterceptNotice is sent to clients in a channel when its protocol data is being intercepted.
+const InterceptNotice = "This server is intercepting protocol data in this channel."
+
 var (
 	MsgErr          = Msg{"type": "error", "error": "invalid_parameters"}
+	MsgNotAllowed   = Msg{"type": "error", "error": "not_allowed"}
 	MsgNotConnected = Msg{"type": TypeNvdaNotConnected}
+	MsgPing         = Msg{"type": TypePing}
+	MsgResumeFailed = Msg{"type": "error", "error": "resume_failed"}
 )
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// vhost is a host name that clients can request with SNI, which has its own certificate.
+type vhost struct {
+	host     string
+	certFile string
+	keyFile  string
+}
+
+// parseVhosts parses virtual hosts in the form host=cert.pem or host=cert.pem,key.pem.
+func parseVhosts(specs []string) ([]vhost, error) {
+	vhosts := make([]vhost, 0, len(specs))
+	seen := make(map[string]struct{}, len(specs))
+	for _, spec := range specs {
+		host, files, ok := strings.Cut(spec, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || host == "" || strings.Contains(host, "/") || files == "" {
+			return nil, fmt.Errorf("%w: \"%s\", expected host=cert.pem or host=cert.pem,key.pem", ErrVhost, spec)
+		}
+		if _, ok := seen[host]; ok {
+			return nil, fmt.Errorf("%w: %s is set more than once", ErrVhost, host)
+		}
+		seen[host] = struct{}{}
+		certFile, keyFile, _ := strings.Cut(files, ",")
+		vhosts = append(vhosts, vhost{
+			host:     host,
+			certFile: certFile,
+			keyFile:  keyFile,
+		})
+	}
+	return vhosts, nil
+}
+
+// loadVhosts loads the certificates of the virtual hosts set with -vhost into certs.
+// If reload is greater than 0, the certificate files are checked for changes every reload.
+func loadVhosts(certs *certStore, l *Logger, reload time.Duration) error {
+	vhosts, err := parseVhosts(vhostSpecs)
+	if err != nil {
+		return err
+	}
+	for _, v := range vhosts {
+		cert, err := loadCertFile(v.certFile, v.keyFile)
+		if err != nil {
+			return fmt.Errorf("certificate for %s: %w", v.host, err)
+		}
+		certs.StoreHost(v.host, cert)
+		l.Infof("Certificate for %s loaded from %s. Fingerprint (SHA-256): %s, expires at %s.\n", v.host, v.certFile, certFingerprint(cert.Leaf), cert.Leaf.NotAfter.Format(time.RFC3339))
+		if err := checkCertValidity(cert.Leaf); err != nil {
+			l.Warnf("The certificate for %s will be used, but clients that check its validity will refuse it: %v\n", v.host, err)
+		}
+		if reload > 0 {
+			go certs.watch(l, v.host, v.certFile, v.keyFile, reload)
+		}
+	}
+	return nil
+}
+
+// setNamespace isolates the channels of the client in the namespace of the virtual host it requested with SNI.
+// Each virtual host has its own namespace, named after the host.
+// Clients that did not request a virtual host share the namespace with an empty name.
+func (c *Client) setNamespace(serverName string) {
+	c.namespace, _ = c.srv.certs.matchHost(serverName)
+	c.isolated = true
+}
+
+// qualifyChannel returns the name the server uses for a channel requested by the client.
+// In an isolated namespace, the channel is prefixed with the namespace and a slash,
+// which can't appear in a host name, so channels of different namespaces never share a name.
+func (c *Client) qualifyChannel(channel string) string {
+	if !c.isolated {
+		return channel
+	}
+	return c.namespace + "/" + channel
+}
+
+// requestedChannel returns the name of the channel as requested by the client, without its namespace.
+func (c *Client) requestedChannel() string {
+	if !c.isolated {
+		return c.channel
+	}
+	return strings.TrimPrefix(c.channel, c.namespace+"/")
+}
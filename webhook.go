@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// webhookEvent is the JSON payload posted to webhook URLs.
+type webhookEvent struct {
+	Event          string    `json:"event"`
+	Time           time.Time `json:"time"`
+	ChannelHash    string    `json:"channel_hash"`
+	ClientID       uint64    `json:"client_id,omitempty"`
+	ConnectionType string    `json:"connection_type,omitempty"`
+	RemoteAddr     string    `json:"remote_addr,omitempty"`
+}
+
+// channelHash returns an identifier for a channel that does not reveal its key, which would let anyone who sees it join the channel.
+func channelHash(channel string) string {
+	sum := sha256.Sum256([]byte(channel))
+	return hex.EncodeToString(sum[:ChannelHashBytes])
+}
+
+// webhook delivers channel lifecycle events to one or more URLs.
+// Each URL has its own bounded queue and delivery goroutine,
+// so a slow or unreachable endpoint never blocks the server or other endpoints.
+type webhook struct {
+	l       *Logger
+	secret  []byte
+	targets []*webhookTarget
+}
+
+type webhookTarget struct {
+	wh     *webhook
+	url    string
+	ch     chan []byte
+	client *http.Client
+}
+
+// newWebhook creates a webhook for the given URLs.
+// Invalid URLs are logged and skipped.
+// If no valid URLs are given, nil is returned, and all methods on the nil webhook do nothing.
+func newWebhook(urls []string, secret string, l *Logger) *webhook {
+	wh := &webhook{
+		l:      l,
+		secret: []byte(secret),
+	}
+	for _, u := range urls {
+		pu, err := url.Parse(u)
+		if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			l.Errorf("Invalid webhook URL \"%s\", it will not be used.\n", u)
+			continue
+		}
+		t := &webhookTarget{
+			wh:     wh,
+			url:    u,
+			ch:     make(chan []byte, WebhookQueueSize),
+			client: &http.Client{Timeout: WebhookTimeout},
+		}
+		wh.targets = append(wh.targets, t)
+		go t.start()
+		l.Debugf("Webhook created for URL %s\n", u)
+	}
+	if len(wh.targets) == 0 {
+		return nil
+	}
+	return wh
+}
+
+// Send queues the event for delivery to every webhook URL.
+// If the queue for a URL is full, the event is dropped for that URL.
+func (wh *webhook) Send(ev webhookEvent) {
+	if wh == nil {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	body, err := json.Marshal(ev)
+	if err != nil {
+		wh.l.Errorf("Unable to encode webhook event %s: %v\n", ev.Event, err)
+		return
+	}
+	for _, t := range wh.targets {
+		select {
+		case t.ch <- body:
+		default:
+			wh.l.Warnf("Webhook queue for %s is full, dropping %s event.\n", t.url, ev.Event)
+		}
+	}
+}
+
+// sign returns the hex encoded HMAC-SHA256 of body using the webhook secret.
+func (wh *webhook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, wh.secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (t *webhookTarget) start() {
+	for body := range t.ch {
+		t.deliver(body)
+	}
+}
+
+// deliver posts body to the target URL, retrying with exponential backoff on failure.
+func (t *webhookTarget) deliver(body []byte) {
+	backoff := WebhookBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := t.post(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= WebhookRetries {
+			t.wh.l.Errorf("Webhook delivery to %s failed after %d attempts: %v\n", t.url, attempt+1, err)
+			return
+		}
+		t.wh.l.Debugf("Webhook delivery to %s failed, retrying in %s: %v\n", t.url, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > WebhookMaxBackoff {
+			backoff = WebhookMaxBackoff
+		}
+	}
+}
+
+// post sends a single delivery attempt.
+// retry reports whether a failed attempt is worth retrying.
+func (t *webhookTarget) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(t.wh.secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+t.wh.sign(body))
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %s", resp.Status)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the requests it receives, answering each with the next status in statuses,
+// and http.StatusOK once they are used up.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+	received chan struct{}
+}
+
+func newWebhookReceiver(statuses ...int) (*webhookReceiver, *httptest.Server) {
+	r := &webhookReceiver{
+		statuses: statuses,
+		received: make(chan struct{}, 16),
+	}
+	return r, httptest.NewServer(r)
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	r.bodies = append(r.bodies, body)
+	r.headers = append(r.headers, req.Header.Clone())
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	r.mu.Unlock()
+	w.WriteHeader(status)
+	r.received <- struct{}{}
+}
+
+func (r *webhookReceiver) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(WebhookBackoff * 5):
+			t.Fatalf("received %d of %d webhook requests", i, n)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	r, ts := newWebhookReceiver()
+	defer ts.Close()
+	wh := newWebhook([]string{ts.URL}, "secret", NewLogger(LogLevelNone, LogFormatText))
+	if wh == nil {
+		t.Fatal("webhook not created")
+	}
+
+	wh.Send(webhookEvent{
+		Event:       EventClientJoined,
+		ChannelHash: channelHash("key"),
+		ClientID:    5,
+	})
+	r.wait(t, 1)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	body, header := r.bodies[0], r.headers[0]
+	if ct := header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	if sig, want := header.Get(WebhookSignatureHeader), "sha256="+hex.EncodeToString(mac.Sum(nil)); sig != want {
+		t.Errorf("%s = %q, want %q", WebhookSignatureHeader, sig, want)
+	}
+
+	var ev webhookEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		t.Fatalf("invalid webhook body %s: %v", body, err)
+	}
+	if ev.Event != EventClientJoined || ev.ClientID != 5 || ev.Time.IsZero() {
+		t.Errorf("unexpected webhook event %+v", ev)
+	}
+	if strings.Contains(string(body), `"key"`) || ev.ChannelHash != channelHash("key") {
+		t.Errorf("webhook body %s reveals the channel key or lacks its hash", body)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	r, ts := newWebhookReceiver(http.StatusServiceUnavailable, http.StatusInternalServerError)
+	defer ts.Close()
+	wh := newWebhook([]string{ts.URL}, "", NewLogger(LogLevelNone, LogFormatText))
+
+	wh.Send(webhookEvent{Event: EventChannelCreated})
+	r.wait(t, 3)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, body := range r.bodies[1:] {
+		if string(body) != string(r.bodies[0]) {
+			t.Errorf("retry %d sent %s, want %s", i+1, body, r.bodies[0])
+		}
+	}
+	if sig := r.headers[0].Get(WebhookSignatureHeader); sig != "" {
+		t.Errorf("unsigned webhook sent %s = %q", WebhookSignatureHeader, sig)
+	}
+}
+
+func TestWebhookNoRetryOnClientError(t *testing.T) {
+	r, ts := newWebhookReceiver(http.StatusBadRequest)
+	defer ts.Close()
+	wh := newWebhook([]string{ts.URL}, "", NewLogger(LogLevelNone, LogFormatText))
+
+	wh.Send(webhookEvent{Event: EventChannelCreated})
+	r.wait(t, 1)
+	select {
+	case <-r.received:
+		t.Fatal("webhook retried after a 4xx response")
+	case <-time.After(WebhookBackoff * 2):
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes, from RFC 6455.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// WebSocket close codes, from RFC 6455.
+const (
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+)
+
+// wsGUID is appended to the key of a WebSocket handshake to compute the accept key.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsListener accepts WebSocket connections on a TCP or TLS listener.
+// Each WebSocket message carries one line of the protocol, so WebSocket clients use the same protocol as other clients.
+type wsListener struct {
+	ln      net.Listener
+	srv     *http.Server
+	path    string
+	origins []string
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+	l       *Logger
+}
+
+// listenWebSocket serves WebSocket connections on ln, at the path in the path option of spec.
+// If the origins option is set, browsers can only connect from pages at those origins.
+func (s *Server) listenWebSocket(spec listenSpec, ln net.Listener) (net.Listener, error) {
+	path := spec.option("path", "/")
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("%w: path %s must start with /", ErrListenSpec, path)
+	}
+	wl := &wsListener{
+		ln:      ln,
+		path:    path,
+		origins: splitList(spec.option("origins", "")),
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+		l:       s.l,
+	}
+	wl.srv = &http.Server{
+		Handler:           wl,
+		ReadHeaderTimeout: WebSocketHandshakeTimeout,
+	}
+	go func() {
+		_ = wl.srv.Serve(ln)
+	}()
+	s.l.Infof("Listener %s accepts WebSocket connections at %s\n", ln.Addr(), path)
+	return wl, nil
+}
+
+// Accept implements net.Listener for wsListener.
+func (wl *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-wl.conns:
+		return conn, nil
+	case <-wl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener for wsListener.
+// Connections that were already accepted are not closed.
+func (wl *wsListener) Close() error {
+	var err error
+	wl.once.Do(func() {
+		close(wl.done)
+		err = wl.srv.Close()
+	})
+	return err
+}
+
+// Addr implements net.Listener for wsListener.
+func (wl *wsListener) Addr() net.Addr {
+	return wl.ln.Addr()
+}
+
+// ServeHTTP implements http.Handler for wsListener, upgrading requests to WebSocket connections.
+func (wl *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != wl.path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "This address only accepts WebSocket connections.", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version.", http.StatusBadRequest)
+		return
+	}
+	if !wl.originAllowed(r.Header.Get("Origin")) {
+		wl.l.Debugf("WebSocket connection from %s rejected for origin %s\n", r.RemoteAddr, r.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed.", http.StatusForbidden)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket connections are not supported.", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		wl.l.Errorf("Unable to take over WebSocket connection from %s: %v\n", r.RemoteAddr, err)
+		return
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	_ = conn.SetDeadline(time.Now().Add(WebSocketHandshakeTimeout))
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	select {
+	case wl.conns <- &wsConn{Conn: conn, r: brw.Reader, tlsState: r.TLS}:
+	case <-wl.done:
+		conn.Close()
+	}
+}
+
+// originAllowed reports whether a browser page at origin may connect.
+// Clients other than browsers don't send an origin, and are always allowed.
+func (wl *wsListener) originAllowed(origin string) bool {
+	if len(wl.origins) == 0 || origin == "" {
+		return true
+	}
+	for _, o := range wl.origins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerContains reports whether the comma separated values of a header contain value, ignoring case.
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, item := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a WebSocket connection.
+// Read returns the data of received messages, each followed by a newline if it doesn't end with one.
+// Write sends each line written to it as a text message, without its newline.
+type wsConn struct {
+	net.Conn
+	r        *bufio.Reader
+	tlsState *tls.ConnectionState
+	buf      []byte
+	wmu      sync.Mutex
+	wbuf     []byte // start of a line written without its newline, guarded by wmu
+	wdrop    bool   // whether the rest of the line being written is dropped, guarded by wmu
+	once     sync.Once
+}
+
+// Read implements net.Conn for wsConn.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) > 0 && msg[len(msg)-1] != Delimiter {
+			msg = append(msg, Delimiter)
+		}
+		c.buf = msg
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Write implements net.Conn for wsConn, sending each line in p as one text message.
+// The start of a line without its newline is kept until the rest of the line is written,
+// so that a line written in parts, such as a line longer than the read buffer of the client that sent it, is still sent as one message.
+// Lines longer than WebSocketMaxMessageSize are dropped, as they would be too large for WebSocket clients to send.
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, Delimiter)
+		if i < 0 {
+			c.pending(p)
+			break
+		}
+		line := p[:i]
+		p = p[i+1:]
+		if len(c.wbuf) > 0 || c.wdrop {
+			c.pending(line)
+			line = c.wbuf
+		}
+		drop := c.wdrop
+		c.wbuf, c.wdrop = c.wbuf[:0], false
+		if drop || len(line) == 0 {
+			continue
+		}
+		if err := c.writeFrame(wsOpText, line); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// pending keeps part of a line until its newline is written. The caller must hold wmu.
+func (c *wsConn) pending(b []byte) {
+	if c.wdrop {
+		return
+	}
+	if len(c.wbuf)+len(b) > WebSocketMaxMessageSize {
+		c.wbuf, c.wdrop = c.wbuf[:0], true
+		return
+	}
+	c.wbuf = append(c.wbuf, b...)
+}
+
+// Close implements net.Conn for wsConn, sending a close message if no other message is being sent.
+func (c *wsConn) Close() error {
+	c.once.Do(func() {
+		if c.wmu.TryLock() {
+			_ = c.SetWriteDeadline(time.Now().Add(WriteDeadlineDuration))
+			_ = c.writeFrame(wsOpClose, wsClosePayload(wsCloseNormal))
+			c.wmu.Unlock()
+		}
+	})
+	return c.Conn.Close()
+}
+
+// sendClose sends a close message with payload, unless one was already sent.
+func (c *wsConn) sendClose(payload []byte) {
+	c.once.Do(func() {
+		c.wmu.Lock()
+		_ = c.SetWriteDeadline(time.Now().Add(WriteDeadlineDuration))
+		_ = c.writeFrame(wsOpClose, payload)
+		c.wmu.Unlock()
+	})
+}
+
+// readMessage reads the next data message, answering control messages received before it.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsOpPing:
+			c.wmu.Lock()
+			err = c.writeFrame(wsOpPong, payload)
+			c.wmu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// The close message is echoed with its status code, as required by RFC 6455, section 5.5.1.
+			var code []byte
+			if len(payload) >= 2 {
+				code = payload[:2]
+			}
+			c.sendClose(code)
+			return nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if started {
+				return nil, c.fail(wsCloseProtocolError, "new message before the previous message finished")
+			}
+			started = true
+		case wsOpContinuation:
+			if !started {
+				return nil, c.fail(wsCloseProtocolError, "continuation without a message")
+			}
+		default:
+			return nil, c.fail(wsCloseProtocolError, fmt.Sprintf("unknown opcode %d", op))
+		}
+		if len(msg)+len(payload) > WebSocketMaxMessageSize {
+			return nil, c.fail(wsCloseTooBig, "message is too large")
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// readFrame reads a single frame, unmasking its payload.
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.r, hdr[:]); err != nil {
+		return
+	}
+	fin, op = hdr[0]&0x80 != 0, hdr[0]&0x0F
+	if hdr[0]&0x70 != 0 {
+		return fin, op, nil, c.fail(wsCloseProtocolError, "reserved bits are set")
+	}
+	if hdr[1]&0x80 == 0 {
+		return fin, op, nil, c.fail(wsCloseProtocolError, "frame from client is not masked")
+	}
+	size := uint64(hdr[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsOpClose && (size > 125 || !fin) {
+		return fin, op, nil, c.fail(wsCloseProtocolError, "invalid control frame")
+	}
+	if size > WebSocketMaxMessageSize {
+		return fin, op, nil, c.fail(wsCloseTooBig, "message is too large")
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame writes a single unmasked frame. The caller must hold wmu.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|op)
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// fail sends a close message with code, and returns an error with the reason.
+func (c *wsConn) fail(code uint16, reason string) error {
+	c.sendClose(wsClosePayload(code))
+	return fmt.Errorf("%w: %s", ErrWebSocket, reason)
+}
+
+func wsClosePayload(code uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, code)
+}
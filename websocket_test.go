@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsClientFrame returns a frame as a client sends it, with its payload masked.
+func wsClientFrame(fin bool, op byte, payload []byte) []byte {
+	b := op
+	if fin {
+		b |= 0x80
+	}
+	frame := []byte{b}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	mask := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	frame = append(frame, mask[:]...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	return frame
+}
+
+// wsReadServerFrame reads a frame sent by the server, which must not be masked.
+func wsReadServerFrame(t *testing.T, r io.Reader) (op byte, payload []byte) {
+	t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	if hdr[0]&0x80 == 0 {
+		t.Fatal("frame from server is fragmented")
+	}
+	if hdr[1]&0x80 != 0 {
+		t.Fatal("frame from server is masked")
+	}
+	size := uint64(hdr[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			t.Fatalf("reading frame length: %v", err)
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			t.Fatalf("reading frame length: %v", err)
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("reading frame payload: %v", err)
+	}
+	return hdr[0] & 0x0F, payload
+}
+
+// wsPipe returns a wsConn for the server, and the other end of its connection for the client.
+func wsPipe(t *testing.T) (*wsConn, net.Conn) {
+	t.Helper()
+	srv, cli := net.Pipe()
+	t.Cleanup(func() {
+		srv.Close()
+		cli.Close()
+	})
+	_ = cli.SetDeadline(time.Now().Add(5 * time.Second))
+	return &wsConn{Conn: srv, r: bufio.NewReader(srv)}, cli
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := parseListenSpec("ws://" + ln.Addr().String() + "?path=/remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{l: NewLogger(LogLevelNone, LogFormatText)}
+	wl, err := s.listenWebSocket(spec, ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wl.Close()
+
+	request := func(path string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// The key and accept key are the example from RFC 6455, section 1.3.
+		_, err = io.WriteString(conn, "GET "+path+" HTTP/1.1\r\n"+
+			"Host: "+ln.Addr().String()+"\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: keep-alive, Upgrade\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+			"Sec-WebSocket-Version: 13\r\n\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, r, resp
+	}
+
+	conn, _, resp := request("/other")
+	conn.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("request for another path got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	conn, r, resp := request("/remote")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("got accept key %q, want %q", got, want)
+	}
+
+	sc, err := wl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	if _, err := conn.Write(wsClientFrame(true, wsOpText, []byte(`{"type":"join"}`))); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(sc).ReadString(Delimiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "{\"type\":\"join\"}\n" {
+		t.Errorf("got line %q", line)
+	}
+
+	go func() {
+		_, _ = sc.Write([]byte("{\"type\":\"channel_joined\"}\n"))
+	}()
+	if op, payload := wsReadServerFrame(t, r); op != wsOpText || string(payload) != `{"type":"channel_joined"}` {
+		t.Errorf("got opcode %d with payload %q", op, payload)
+	}
+}
+
+func TestWebSocketRead(t *testing.T) {
+	c, cli := wsPipe(t)
+	go func() {
+		var frames []byte
+		frames = append(frames, wsClientFrame(false, wsOpText, []byte("hello "))...)
+		frames = append(frames, wsClientFrame(true, wsOpPing, []byte("ping"))...)
+		frames = append(frames, wsClientFrame(true, wsOpContinuation, []byte("world"))...)
+		// A message with a payload over 125 bytes uses a 16 bit length.
+		frames = append(frames, wsClientFrame(true, wsOpText, bytes.Repeat([]byte("a"), 300))...)
+		_, _ = cli.Write(frames)
+	}()
+
+	lines := make(chan string, 2)
+	go func() {
+		r := bufio.NewReader(c)
+		for i := 0; i < 2; i++ {
+			line, _ := r.ReadString(Delimiter)
+			lines <- line
+		}
+	}()
+
+	if op, payload := wsReadServerFrame(t, cli); op != wsOpPong || string(payload) != "ping" {
+		t.Errorf("ping was answered with opcode %d and payload %q", op, payload)
+	}
+	if line := <-lines; line != "hello world\n" {
+		t.Errorf("got line %q, want %q", line, "hello world\n")
+	}
+	if line, want := <-lines, strings.Repeat("a", 300)+"\n"; line != want {
+		t.Errorf("got line of %d bytes, want %d", len(line), len(want))
+	}
+}
+
+func TestWebSocketCloseEcho(t *testing.T) {
+	c, cli := wsPipe(t)
+	go func() {
+		_, _ = cli.Write(wsClientFrame(true, wsOpClose, append(wsClosePayload(1001), "going away"...)))
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 16))
+		errc <- err
+	}()
+	op, payload := wsReadServerFrame(t, cli)
+	if op != wsOpClose || !bytes.Equal(payload, wsClosePayload(1001)) {
+		t.Errorf("close was answered with opcode %d and payload %v, want the status code 1001", op, payload)
+	}
+	if err := <-errc; err != io.EOF {
+		t.Errorf("Read returned %v, want io.EOF", err)
+	}
+}
+
+func TestWebSocketUnmaskedFrame(t *testing.T) {
+	c, cli := wsPipe(t)
+	go func() {
+		frame := wsClientFrame(true, wsOpText, []byte("data"))
+		frame[1] &^= 0x80
+		_, _ = cli.Write(frame[:2])
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 16))
+		errc <- err
+	}()
+	op, payload := wsReadServerFrame(t, cli)
+	if op != wsOpClose || !bytes.Equal(payload, wsClosePayload(wsCloseProtocolError)) {
+		t.Errorf("got opcode %d and payload %v, want a close message with status code %d", op, payload, wsCloseProtocolError)
+	}
+	if err := <-errc; !errors.Is(err, ErrWebSocket) {
+		t.Errorf("Read returned %v, want %v", err, ErrWebSocket)
+	}
+}
+
+func TestWebSocketWrite(t *testing.T) {
+	c, cli := wsPipe(t)
+	long := bytes.Repeat([]byte("b"), 70000)
+	go func() {
+		// A line written in parts, as lines longer than the read buffer of the sending client are, is sent as one message.
+		_, _ = c.Write([]byte(`{"type":`))
+		_, _ = c.Write([]byte("\"a\"}\n{\"type\":\"b\"}\n{\"ty"))
+		_, _ = c.Write([]byte("pe\":\"c\"}\n"))
+		// A line with a payload over 65535 bytes uses a 64 bit length.
+		_, _ = c.Write(long[:40000])
+		_, _ = c.Write(append(long[40000:], Delimiter))
+		// A line too large for WebSocket clients to send is dropped.
+		_, _ = c.Write(bytes.Repeat([]byte("c"), WebSocketMaxMessageSize))
+		_, _ = c.Write([]byte("c\n"))
+		_, _ = c.Write([]byte("{\"type\":\"d\"}\n"))
+	}()
+
+	want := [][]byte{
+		[]byte(`{"type":"a"}`),
+		[]byte(`{"type":"b"}`),
+		[]byte(`{"type":"c"}`),
+		long,
+		[]byte(`{"type":"d"}`),
+	}
+	for _, w := range want {
+		op, payload := wsReadServerFrame(t, cli)
+		if op != wsOpText || !bytes.Equal(payload, w) {
+			t.Fatalf("got opcode %d with %d bytes of payload %q, want %q", op, len(payload), truncate(payload, 16), truncate(w, 16))
+		}
+	}
+}
@@ -21,7 +21,9 @@ func newWritech(c *Client) *writech {
 		c:  c,
 		ch: make(chan []byte, WriteBufSize),
 	}
-	c.srv.l.Debugf("Write buffer created for client %s: size %d.\n", c.value(), WriteBufSize)
+	c.log().Debugf("Write buffer created for client %s: size %d.\n", c.value(), WriteBufSize)
+	// Logged before the write channel is started, as the client changes during its handshake.
+	c.log().Debugf("Write channel for client %s opened.\n", c.value())
 	wch.wg.Add(1)
 	go wch.start()
 	return wch
@@ -40,7 +42,7 @@ func (wch *writech) Close() {
 		wch.mu.Lock()
 		wch.ch = nil
 		wch.mu.Unlock()
-		c.srv.l.Debugf("Write buffer for client %s closed.\n", c.value())
+		c.log().Debugf("Write buffer for client %s closed.\n", c.value())
 	})
 }
 
@@ -54,7 +56,7 @@ func (wch *writech) Write(p []byte) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = net.ErrClosed
-			wch.c.srv.l.Debugf("Panic caught for client %s: %s\n", wch.c.value(), r)
+			wch.c.log().Debugf("Panic caught for client %s: %s\n", wch.c.value(), r)
 		}
 	}()
 
@@ -70,23 +72,25 @@ func (wch *writech) isClosed() bool {
 
 func (wch *writech) start() {
 	c := wch.c
-	c.srv.l.Debugf("Write channel for client %s opened.\n", c.value())
 	defer c.Close()
 	defer wch.Close()
 	defer wch.wg.Done()
 	for buf := range wch.ch {
-		c.srv.l.Interceptf("Sent data to client %s\n%s\n", c.value(), buf)
+		c.interceptData("Sent data to", buf)
 		// Because data is sent sequentially, set a write deadline.
 		deadlineErr := c.conn.SetWriteDeadline(time.Now().Add(WriteDeadlineDuration))
-		if deadlineErr != nil {
-			c.srv.l.Errorf("SetWriteDeadline failed for client %s: %v\n", c.value(), deadlineErr)
+		if deadlineErr != nil && !c.isClosed() {
+			c.log().Errorf("SetWriteDeadline failed for client %s: %v\n", c.value(), deadlineErr)
 		}
 		startTime := time.Now()
 		_, err := c.conn.Write(buf)
 		if err != nil {
 			// if writing fails, log and close the writer
-			if !c.isClosed() {
-				c.srv.l.Errorf("Write error from client %s: %v\n", c.value(), err)
+			if isDeadPeer(err) && !c.isClosed() {
+				c.markDead()
+				c.log().Warnf("Client %s stopped responding, disconnecting: %v\n", c.value(), err)
+			} else if !c.isClosed() {
+				c.log().Errorf("Write error from client %s: %v\n", c.value(), err)
 			}
 			return
 		}